@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"perwindowlayout/config"
+	"perwindowlayout/hypr"
+)
+
+// checkConfig prints all problems of the config at path and reports whether
+// there were none. Layout names are checked against layouts of the running
+// Hyprland, if there is one.
+func checkConfig(ctx context.Context, path, layoutCachePath, instance string, w io.Writer) bool {
+	var layouts []string
+	client, clientClose, err := hypr.NewClient(ctx, instanceOptions(instance)...)
+	if err != nil {
+		fmt.Fprintf(w, "Not checking layout names: %s\n", err)
+	} else {
+		defer clientClose()
+		client.LayoutCachePath = layoutCachePath
+		if cfg, err := config.Load(path); err == nil {
+			client.KeyboardName = cfg.Keyboard()
+			client.KnownLayouts = cfg.Layouts
+		}
+		detected, err := client.ReadLayouts(ctx)
+		if err != nil {
+			fmt.Fprintf(w, "Not checking layout names: could not detect layouts: %s\n", err)
+		} else {
+			layouts = detected.Names
+		}
+	}
+	errs := config.Check(path, layouts)
+	for _, err := range errs {
+		fmt.Fprintln(w, err)
+	}
+	if len(errs) > 0 {
+		return false
+	}
+	fmt.Fprintf(w, "%s is valid\n", path)
+	return true
+}
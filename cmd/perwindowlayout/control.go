@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"perwindowlayout"
+	"strings"
+	"time"
+)
+
+func defaultControlSocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("per-window-layout-%d.sock", os.Getuid()))
+}
+
+// serveControl listens on the unix socket at path and answers line-based
+// requests in a separate goroutine. Supported requests:
+//
+//	status - JSON with the active window, its layout and learned layouts
+//	set-layout <index-or-name> - switch the active window to the layout and
+//	remember it, replies with status
+//	ping [max-age] - health of the daemon, it's unhealthy when disconnected
+//	or no events were processed for max-age, like 10m
+//	subscribe - stream of JSON lines, one per layout change, until the client
+//	disconnects
+//	pause, resume, toggle - stop or resume switching layouts on focus, they
+//	are still learned while paused. Replies {"paused": bool}. Can be bound
+//	to a key in hyprland.conf:
+//	bind = SUPER, F12, exec, echo toggle | socat - UNIX-CONNECT:<path>
+//
+// The returned function stops listening and removes the socket.
+func serveControl(path string, opts *options) (func(), error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale control socket %s: %w", path, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	slog.Info(fmt.Sprintf("Control socket listening on %s", path))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Error(fmt.Sprintf("Control socket stopped: %s", err))
+				return
+			}
+			go handleControlConn(conn, opts)
+		}
+	}()
+	return func() {
+		ln.Close()
+	}, nil
+}
+
+// Health is the reply to ping.
+type Health struct {
+	Healthy   bool       `json:"healthy"`
+	Connected bool       `json:"connected"`
+	LastEvent *time.Time `json:"last_event"`
+}
+
+// health reports whether the daemon is connected and processed an event
+// within maxAge, if it's set.
+func health(opts *options, maxAge time.Duration) Health {
+	h := Health{Connected: opts.daemon.Connected()}
+	h.Healthy = h.Connected
+	if last := opts.daemon.LastEvent(); !last.IsZero() {
+		h.LastEvent = &last
+	}
+	if maxAge > 0 && (h.LastEvent == nil || time.Since(*h.LastEvent) > maxAge) {
+		h.Healthy = false
+	}
+	return h
+}
+
+// controlWriteTimeout is how long a subscriber may take to receive a line.
+const controlWriteTimeout = 5 * time.Second
+
+// streamChanges writes layout changes to the subscribed connection until it's
+// closed or dropped for being slow.
+func streamChanges(conn net.Conn, scanner *bufio.Scanner, d *perwindowlayout.Daemon) {
+	changes, unsubscribe := d.Subscribe()
+	defer unsubscribe()
+	go func() {
+		// Nothing is expected from subscriber, reading detects disconnect
+		for scanner.Scan() {
+		}
+		unsubscribe()
+	}()
+	for line := range changes {
+		conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+		if _, err := conn.Write(append(line, '\n')); err != nil {
+			slog.Debug("Subscriber is gone", "err", err)
+			return
+		}
+	}
+}
+
+func handleControlConn(conn net.Conn, opts *options) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		cmd := strings.Fields(line)
+		if len(cmd) == 0 {
+			continue
+		}
+		var reply any
+		switch cmd[0] {
+		case "status":
+			status, err := opts.daemon.Status()
+			if err != nil {
+				reply = map[string]string{"error": err.Error()}
+				break
+			}
+			reply = status
+		case "ping":
+			var maxAge time.Duration
+			if len(cmd) > 1 {
+				var err error
+				if maxAge, err = time.ParseDuration(cmd[1]); err != nil {
+					reply = map[string]string{"error": fmt.Sprintf("invalid max-age: %s", err)}
+					break
+				}
+			}
+			reply = health(opts, maxAge)
+		case "pause", "resume", "toggle":
+			paused := cmd[0] == "pause"
+			if cmd[0] == "toggle" {
+				paused = opts.daemon.TogglePaused()
+			} else {
+				opts.daemon.SetPaused(paused)
+			}
+			reply = map[string]bool{"paused": paused}
+		case "subscribe":
+			streamChanges(conn, scanner, opts.daemon)
+			return
+		case "set-layout":
+			if len(cmd) < 2 {
+				reply = map[string]string{"error": "usage: set-layout <index-or-name>"}
+				break
+			}
+			// Layout names may contain spaces, like "English (US)"
+			layout := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), cmd[0]))
+			if err := opts.daemon.SetLayout(layout); err != nil {
+				reply = map[string]string{"error": err.Error()}
+				break
+			}
+			status, err := opts.daemon.Status()
+			if err != nil {
+				reply = map[string]string{"error": err.Error()}
+				break
+			}
+			reply = status
+		default:
+			reply = map[string]string{"error": fmt.Sprintf("unknown command %q", cmd[0])}
+		}
+		if err := enc.Encode(reply); err != nil {
+			slog.Debug("Failed to reply on control socket", "err", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"perwindowlayout"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+const (
+	dbusName  = "io.github.GomZik.PerWindowLayout"
+	dbusPath  = dbus.ObjectPath("/io/github/GomZik/PerWindowLayout")
+	dbusIface = dbusName
+)
+
+// dbusService is the session bus API of the daemon, the same the control
+// socket provides:
+//
+//	GetLayout() -> (name string, index int32) - layout of the focused window
+//	GetWindowLayouts() -> map[string]int32 - learned layouts by window
+//	SetLayout(layout string) - switch the focused window to the layout,
+//	given by index or name, and remember it
+//	SetPaused(paused bool) - stop or resume switching layouts on focus
+type dbusService struct {
+	daemon *perwindowlayout.Daemon
+}
+
+func (s *dbusService) GetLayout() (string, int32, *dbus.Error) {
+	status, err := s.daemon.Status()
+	if err != nil {
+		return "", 0, dbus.MakeFailedError(err)
+	}
+	return status.LayoutName, int32(status.Layout), nil
+}
+
+func (s *dbusService) GetWindowLayouts() (map[string]int32, *dbus.Error) {
+	status, err := s.daemon.Status()
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	layouts := make(map[string]int32, len(status.LayoutMap))
+	for window, layout := range status.LayoutMap {
+		layouts[window] = int32(layout)
+	}
+	return layouts, nil
+}
+
+func (s *dbusService) SetLayout(layout string) *dbus.Error {
+	if err := s.daemon.SetLayout(layout); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *dbusService) SetPaused(paused bool) *dbus.Error {
+	s.daemon.SetPaused(paused)
+	return nil
+}
+
+const dbusIntrospection = `
+<node>
+	<interface name="` + dbusIface + `">
+		<method name="GetLayout">
+			<arg direction="out" type="s" name="name"/>
+			<arg direction="out" type="i" name="index"/>
+		</method>
+		<method name="GetWindowLayouts">
+			<arg direction="out" type="a{si}" name="layouts"/>
+		</method>
+		<method name="SetLayout">
+			<arg direction="in" type="s" name="layout"/>
+		</method>
+		<method name="SetPaused">
+			<arg direction="in" type="b" name="paused"/>
+		</method>
+	</interface>` + introspect.IntrospectDataString + `</node>`
+
+// serveDBus exports the daemon API on the session bus, calls are served by
+// the bus connection goroutines. The returned function closes the connection.
+func serveDBus(opts *options) (func(), error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+	if err := conn.Export(&dbusService{daemon: opts.daemon}, dbusPath, dbusIface); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to export dbus service: %w", err)
+	}
+	if err := conn.Export(introspect.Introspectable(dbusIntrospection), dbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to export dbus introspection: %w", err)
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to request dbus name %s: %w", dbusName, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, fmt.Errorf("dbus name %s is already taken, is another daemon running?", dbusName)
+	}
+	slog.Info(fmt.Sprintf("Serving dbus API as %s", dbusName))
+	return func() {
+		conn.Close()
+	}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// listLayouts detects layouts and prints them, so users know the names to
+// use in config. asJSON prints them as JSON array for scripts instead.
+func listLayouts(ctx context.Context, opts *options, w io.Writer, asJSON bool) error {
+	client, clientClose, err := connect(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer clientClose()
+
+	detected, err := client.ReadLayouts(ctx)
+	if err != nil {
+		return fmt.Errorf("could not detect layouts: %w", err)
+	}
+	if asJSON {
+		return json.NewEncoder(w).Encode(detected.Entries())
+	}
+	fmt.Fprintf(w, "Keyboard: %s\n\n", detected.Keyboard)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tSHORT\tNAME\tACTIVE")
+	for _, e := range detected.Entries() {
+		active := ""
+		if e.Active {
+			active = "*"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", e.Index, e.Short, e.Name, active)
+	}
+	return tw.Flush()
+}
@@ -1,102 +1,447 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
 	"os"
+	"os/signal"
+	"perwindowlayout"
+	"perwindowlayout/config"
 	"perwindowlayout/hypr"
+	"perwindowlayout/xdg"
+	"strings"
+	"syscall"
 	"time"
 )
 
-func processHyprlandEvents(resetRetryCount func()) error {
-	client, clientClose, err := hypr.NewClient()
+// options are the daemon settings that survive reconnects.
+type options struct {
+	configPath      string
+	layoutCachePath string
+	layouts         []string
+	// instance is signature of the Hyprland instance to connect to, empty
+	// for the one from environment
+	instance string
+	recorder *hypr.Recorder
+
+	daemon *perwindowlayout.Daemon
+}
+
+// connect creates Hyprland client set up according to the options.
+func connect(ctx context.Context, opts *options) (*hypr.Client, func(), error) {
+	client, clientClose, err := hypr.NewClient(ctx, instanceOptions(opts.instance)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to the hyprland socket: %w", err)
+	}
+	cfg := opts.daemon.Config()
+	client.LayoutCachePath = opts.layoutCachePath
+	client.Recorder = opts.recorder
+	client.KeyboardName = cfg.Keyboard()
+	client.KnownLayouts = cfg.Layouts
+	if len(opts.layouts) > 0 {
+		client.KnownLayouts = opts.layouts
+	}
+	return client, clientClose, nil
+}
+
+// connectAndProcess connects to the running Hyprland and processes its events
+// until the connection breaks or ctx is cancelled.
+func connectAndProcess(ctx context.Context, opts *options, resetRetryCount func()) error {
+	client, clientClose, err := connect(ctx, opts)
 	if err != nil {
-		return fmt.Errorf("could not connect to the hyprland socket: %w", err)
+		return err
 	}
 	defer clientClose()
+	if opts.recorder != nil {
+		defer func() {
+			if err := opts.recorder.Flush(); err != nil {
+				slog.Error(err.Error())
+			}
+		}()
+	}
+
+	return opts.daemon.Run(ctx, client, resetRetryCount)
+}
+
+const (
+	noKeyboardsWait = 4 * time.Second
+	// backoffJitter is the fraction the reconnect wait is randomly changed
+	// by, so clients restarted together don't reconnect at once
+	backoffJitter = 0.2
+)
 
-	layouts, err := client.ReadLayouts()
+// reloadConfig re-reads the config file and swaps it in, keeping the old one
+// when the new can't be loaded.
+func (o *options) reloadConfig() {
+	cfg, err := config.Load(o.configPath)
 	if err != nil {
-		return fmt.Errorf("could not detect layouts: %w", err)
+		slog.Error(fmt.Sprintf("Could not reload config, keeping the old one: %s", err))
+		return
 	}
-	slog.Debug(fmt.Sprintf("Layouts: %v", layouts))
-	layoutToIndex := make(map[string]int)
-	for i, l := range layouts {
-		layoutToIndex[l] = i
+	o.daemon.SetConfig(cfg)
+	slog.Info(fmt.Sprintf("Reloaded config from %s", o.configPath))
+}
+
+// Environment variables overriding default paths, flags override them in turn.
+const (
+	configEnv      = "PER_WINDOW_LAYOUT_CONFIG"
+	logFileEnv     = "PER_WINDOW_LAYOUT_LOG"
+	stateFileEnv   = "PER_WINDOW_LAYOUT_STATE"
+	layoutCacheEnv = "PER_WINDOW_LAYOUT_CACHE"
+)
+
+// envOr returns value of the environment variable, def when it's not set.
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// instanceOptions selects the Hyprland instance, if it's set.
+func instanceOptions(instance string) []hypr.Option {
+	if instance == "" {
+		return nil
 	}
-	slog.Debug(fmt.Sprintf("Index Mapping: %+v", layoutToIndex))
+	return []hypr.Option{hypr.WithInstance(instance)}
+}
 
-	layoutMap := make(map[string]int, 0)
-	defaultLayout := 0
-	currentWindowId := ""
-	currentLayout := -1
+// splitList splits comma separated flag value.
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	items := strings.Split(v, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+// sleep waits for d, returns false if ctx was cancelled earlier.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
 
+// backoff returns how long to wait before the retry, starting from base and
+// doubling the wait on each attempt up to max.
+func backoff(retry int, base, max time.Duration) time.Duration {
+	wait := base
+	for i := 0; i < retry && wait < max; i++ {
+		wait *= 2
+	}
+	return min(wait, max)
+}
+
+// jitter changes d by up to backoffJitter of it in either direction. rnd
+// returns a number in [0, 1), like rand.Float64.
+func jitter(d time.Duration, rnd func() float64) time.Duration {
+	return d + time.Duration((rnd()*2-1)*backoffJitter*float64(d))
+}
+
+// retrier runs work again each time it fails, waiting longer after each
+// failure in a row.
+type retrier struct {
+	// wait returns the delay before the retry-th retry, counted from 0
+	wait func(retry int) time.Duration
+	// maxRetries is how many failures in a row it puts up with, 0 means no
+	// limit
+	maxRetries int
+	sleep      func(ctx context.Context, d time.Duration) bool
+	// onRetry is called before each retry, may be nil
+	onRetry func()
+}
+
+// run calls work until ctx is cancelled or the retries are exhausted. work
+// calls reset once it made progress, so the next failure is counted as the
+// first one again. Errors which retrying can't fix are returned right away.
+func (r *retrier) run(ctx context.Context, work func(ctx context.Context, reset func()) error) error {
+	// attempt counts all reconnects, unlike retry it's never reset
+	retry, attempt := 0, 0
+	reset := func() {
+		retry = 0
+	}
 	for {
-		evt, err := client.ReadEvent()
-		if err != nil {
-			return fmt.Errorf("failed to read hyprland event: %w", err)
-		}
-		resetRetryCount()
-		switch evt.Name {
-		case "activelayout":
-			{
-				if currentWindowId == "" {
-					continue
-				}
-				currentLayout = layoutToIndex[evt.Args[len(evt.Args)-1]]
-				layoutMap[currentWindowId] = currentLayout
-			}
-		case "activewindowv2":
-			{
-				newWindowId := evt.Args[len(evt.Args)-1]
-				if currentWindowId == newWindowId {
-					continue
-				}
-				currentWindowId = newWindowId
-				windowLayout, known := layoutMap[currentWindowId]
-				if !known {
-					windowLayout = defaultLayout
-				}
-				if windowLayout == currentLayout {
-					continue
-				}
-				err := client.SwitchXKBLayout(windowLayout)
-				if err != nil {
-					return fmt.Errorf("failed to activate layout: %w", err)
-				}
+		err := work(ctx, reset)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, perwindowlayout.ErrSingleLayout) {
+			return err
+		}
+		if errors.Is(err, perwindowlayout.ErrIdle) {
+			// Not a failure, the connection is just replaced
+			slog.Info(fmt.Sprintf("%s, connecting again", err))
+			retry = 0
+			if r.onRetry != nil {
+				r.onRetry()
 			}
+			continue
+		}
+		slog.Error(err.Error())
+		if errors.Is(err, hypr.ErrNoInstance) {
+			return err
+		}
+		if errors.Is(err, hypr.ErrNoKeyboards) {
+			// Happens while Hyprland is starting up, worth waiting for
+			slog.Info(fmt.Sprintf("Waiting %s for keyboards to appear", noKeyboardsWait))
+			r.sleep(ctx, noKeyboardsWait)
+			continue
+		}
+		if r.maxRetries > 0 && retry >= r.maxRetries {
+			return err
+		}
+		wait := r.wait(retry)
+		attempt += 1
+		slog.Info(fmt.Sprintf("Reconnect attempt %d in %s", attempt, wait), "retry", retry, "attempt", attempt, "err", err)
+		r.sleep(ctx, wait)
+		retry += 1
+		if r.onRetry != nil {
+			r.onRetry()
 		}
 	}
-
 }
 
-func main() {
-	logfile, err := os.OpenFile(os.ExpandEnv("$HOME/.per-window-layout.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0655)
+func run() int {
+	initialBackoff := flag.Duration("initial-backoff", 500*time.Millisecond, "delay before the first reconnect attempt, doubled on each next one")
+	maxBackoff := flag.Duration("max-backoff", 30*time.Second, "maximum delay between reconnect attempts")
+	controlSocket := flag.String("control-socket", defaultControlSocketPath(), "path of the control socket, empty disables it")
+	dryRun := flag.Bool("dry-run", false, "log layout switches instead of performing them")
+	notify := flag.Bool("notify", false, "show desktop notification when layout is switched")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	configFile := flag.String("config", envOr(configEnv, config.DefaultPath()), "path of the config file, "+configEnv+" overrides the default")
+	logFile := flag.String("log-file", envOr(logFileEnv, xdg.StateFile("per-window-layout.log")), "path of the log file, - for stderr, "+logFileEnv+" overrides the default")
+	stateFile := flag.String("state-file", os.Getenv(stateFileEnv), "where to keep learned layouts, "+stateFileEnv+" overrides state_file config option")
+	foreground := flag.Bool("foreground", false, "copy logs to stderr, for running in a terminal")
+	logLevel := flag.String("log-level", "debug", "minimal log level: debug, info, warn or error")
+	layoutCache := flag.String("layout-cache", envOr(layoutCacheEnv, xdg.CacheFile("layouts.json")), "where to cache detected layout names, empty disables the cache, "+layoutCacheEnv+" overrides the default")
+	statusFile := flag.String("status-file", perwindowlayout.DefaultStatusFilePath(), "file to keep the current layout name in, empty disables it")
+	knownLayouts := flag.String("layouts", "", "comma separated keymap names in the kb_layout order, skips layout detection")
+	dbusAPI := flag.Bool("dbus", false, "serve the control API on the session bus too")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on that address, like 127.0.0.1:9091")
+	maxRetries := flag.Int("max-retries", 0, "give up after that many failed reconnects in a row, 0 means retry forever")
+	trace := flag.Bool("trace", false, "log every event read from Hyprland, at debug level")
+	check := flag.Bool("check", false, "check the config and exit, non-zero status means it's invalid")
+	replayFile := flag.String("replay", "", "process events recorded in the file instead of Hyprland ones, without switching layouts")
+	replayTiming := flag.Bool("replay-timing", false, "wait between replayed events as long as between the recorded ones")
+	recordFile := flag.String("record", "", "append every event read from Hyprland to the file, for -replay")
+	instance := flag.String("instance", "", "signature of the Hyprland instance to connect to, overrides HYPRLAND_INSTANCE_SIGNATURE")
+	listInstances := flag.Bool("list-instances", false, "print signatures of Hyprland instances and exit")
+	exitIfSingle := flag.Bool("exit-if-single", false, "exit when kb_layout has only one layout, instead of waiting for more")
+	once := flag.Bool("once", false, "print layout of the active window and exit")
+	showVersion := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return 0
+	}
+
+	if *listInstances {
+		instances, err := hypr.ListInstances()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, sig := range instances {
+			fmt.Println(sig)
+		}
+		return 0
+	}
+
+	logOut, err := openLogFile(*logFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open logfile: %s\n", err)
+		return 1
+	}
+	if *foreground && logOut != io.Writer(os.Stderr) {
+		logOut = io.MultiWriter(logOut, os.Stderr)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid log level: %s\n", err)
+		return 1
+	}
+	h, err := newLogHandler(*logFormat, logOut, &slog.HandlerOptions{Level: level})
 	if err != nil {
-		panic(fmt.Errorf("Could not open logfile: %w", err))
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	h := slog.NewTextHandler(logfile, &slog.HandlerOptions{Level: slog.LevelDebug})
 	slog.SetDefault(slog.New(h))
+	slog.Info(fmt.Sprintf("Starting per-window-layout %s", versionString()))
 
-	retry := 0
-	retryWait := []time.Duration{
-		500 * time.Millisecond,
-		time.Second,
-		2 * time.Second,
-		4 * time.Second,
+	configPath := *configFile
+	if *check {
+		if !checkConfig(context.Background(), configPath, *layoutCache, *instance, os.Stdout) {
+			return 1
+		}
+		return 0
 	}
-	resetRetry := func() {
-		retry = 0
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load config: %s\n", err)
+		return 1
 	}
-	for {
-		if err := processHyprlandEvents(resetRetry); err != nil {
+	statePath := *stateFile
+	if statePath == "" {
+		statePath = cfg.StateFile
+	}
+	if statePath == "" {
+		statePath = perwindowlayout.DefaultStatePath()
+	}
+	st, err := perwindowlayout.LoadState(statePath)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Could not load state, starting from scratch: %s", err))
+		st = nil
+	}
+
+	opts := &options{
+		configPath:      configPath,
+		layoutCachePath: *layoutCache,
+		layouts:         splitList(*knownLayouts),
+		instance:        *instance,
+
+		daemon: perwindowlayout.New(cfg, st, perwindowlayout.Options{
+			StatePath:    statePath,
+			DryRun:       *dryRun,
+			Notify:       *notify,
+			StatusFile:   *statusFile,
+			Trace:        *trace,
+			ExitIfSingle: *exitIfSingle,
+			OnReady: func(ctx context.Context) {
+				// Tell systemd once the first connection is set up
+				if err := sdNotify("READY=1"); err != nil {
+					slog.Warn(err.Error())
+				}
+				sdWatchdog(ctx)
+			},
+		}),
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "list-layouts":
+		fs := flag.NewFlagSet("list-layouts", flag.ExitOnError)
+		asJSON := fs.Bool("json", false, "print layouts as JSON array of {index, short, name, active}")
+		fs.Parse(flag.Args()[1:])
+		if err := listLayouts(context.Background(), opts, os.Stdout, *asJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		return 2
+	}
+
+	if *replayFile != "" {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+		err := replay(ctx, *replayFile, *replayTiming, opts, perwindowlayout.Options{Trace: *trace})
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if *once {
+		if err := printOnce(context.Background(), opts, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if *statusFile != "" {
+		defer os.Remove(*statusFile)
+	}
+
+	if *recordFile != "" {
+		recorder, err := hypr.NewRecorder(*recordFile)
+		if err != nil {
 			slog.Error(err.Error())
-			if retry >= len(retryWait) {
-				panic(err)
+			return 1
+		}
+		defer recorder.Close()
+		opts.recorder = recorder
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			// kb_layout may have been changed along with the config
+			if err := opts.daemon.Redetect(); err != nil && !errors.Is(err, perwindowlayout.ErrNotConnected) {
+				slog.Error(err.Error())
 			}
-			slog.Info(fmt.Sprintf("Waiting %s for recover", retryWait[retry]), "retry", retry)
-			<-time.After(retryWait[retry])
-			retry += 1
+			opts.reloadConfig()
+		}
+	}()
+
+	if *controlSocket != "" {
+		stopControl, err := serveControl(*controlSocket, opts)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Could not start control socket: %s", err))
+		} else {
+			defer stopControl()
 		}
 	}
+
+	if *dbusAPI {
+		stopDBus, err := serveDBus(opts)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Could not start dbus API: %s", err))
+		} else {
+			defer stopDBus()
+		}
+	}
+
+	if *metricsAddr != "" {
+		serveMetrics(ctx, *metricsAddr, opts)
+	}
+
+	r := &retrier{
+		wait: func(retry int) time.Duration {
+			return jitter(backoff(retry, *initialBackoff, *maxBackoff), rand.Float64)
+		},
+		maxRetries: *maxRetries,
+		sleep:      sleep,
+		onRetry: func() {
+			opts.daemon.Reconnected()
+		},
+	}
+	err = r.run(ctx, func(ctx context.Context, reset func()) error {
+		return connectAndProcess(ctx, opts, reset)
+	})
+	if ctx.Err() != nil {
+		slog.Info("Shutting down")
+		return 0
+	}
+	if errors.Is(err, perwindowlayout.ErrSingleLayout) {
+		slog.Info("Only one layout is configured, exiting")
+		return 0
+	}
+	slog.Error(fmt.Sprintf("Giving up: %s", err))
+	return 1
+}
+
+func main() {
+	os.Exit(run())
 }
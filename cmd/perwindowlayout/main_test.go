@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"perwindowlayout"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{4, 16 * time.Second},
+		{5, 30 * time.Second},
+		{6, 30 * time.Second},
+		{1000, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.retry, time.Second, 30*time.Second); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.retry, got, tt.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, rnd := range []float64{0, 0.5, 0.999} {
+		got := jitter(10*time.Second, func() float64 { return rnd })
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Errorf("jitter(10s) with %v = %s, want within 20%%", rnd, got)
+		}
+	}
+}
+
+// testRetrier returns retrier which records waits instead of sleeping.
+func testRetrier(maxRetries int) (*retrier, *[]time.Duration) {
+	var waits []time.Duration
+	return &retrier{
+		wait: func(retry int) time.Duration {
+			return backoff(retry, time.Second, 4*time.Second)
+		},
+		maxRetries: maxRetries,
+		sleep: func(ctx context.Context, d time.Duration) bool {
+			waits = append(waits, d)
+			return true
+		},
+	}, &waits
+}
+
+func TestRetrierGivesUp(t *testing.T) {
+	r, waits := testRetrier(4)
+	errFailed := errors.New("failed")
+	calls := 0
+	err := r.run(context.Background(), func(ctx context.Context, reset func()) error {
+		calls++
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("run() = %v, want %v", err, errFailed)
+	}
+	if calls != 5 {
+		t.Errorf("work called %d times, want 5", calls)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	if !slices.Equal(*waits, want) {
+		t.Errorf("waits = %v, want %v", *waits, want)
+	}
+}
+
+func TestRetrierReset(t *testing.T) {
+	r, waits := testRetrier(3)
+	errFailed := errors.New("failed")
+	calls := 0
+	err := r.run(context.Background(), func(ctx context.Context, reset func()) error {
+		calls++
+		if calls == 3 || calls == 6 {
+			// Connected for a while before failing
+			reset()
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("run() = %v, want %v", err, errFailed)
+	}
+	want := []time.Duration{
+		time.Second, 2 * time.Second,
+		time.Second, 2 * time.Second, 4 * time.Second,
+		time.Second, 2 * time.Second, 4 * time.Second,
+	}
+	if !slices.Equal(*waits, want) {
+		t.Errorf("waits = %v, want %v", *waits, want)
+	}
+}
+
+func TestRetrierStops(t *testing.T) {
+	r, waits := testRetrier(0)
+	err := r.run(context.Background(), func(ctx context.Context, reset func()) error {
+		return perwindowlayout.ErrSingleLayout
+	})
+	if !errors.Is(err, perwindowlayout.ErrSingleLayout) {
+		t.Errorf("run() = %v, want %v", err, perwindowlayout.ErrSingleLayout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = r.run(ctx, func(ctx context.Context, reset func()) error {
+		if len(*waits) == 10 {
+			cancel()
+		}
+		return errors.New("failed")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("run() = %v, want %v", err, context.Canceled)
+	}
+	if len(*waits) != 10 {
+		t.Errorf("retried %d times without limit before cancel, want 10", len(*waits))
+	}
+}
+
+func TestRetrierIdle(t *testing.T) {
+	r, waits := testRetrier(1)
+	reconnects := 0
+	r.onRetry = func() {
+		reconnects++
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := r.run(ctx, func(ctx context.Context, reset func()) error {
+		calls++
+		if calls == 5 {
+			cancel()
+		}
+		return perwindowlayout.ErrIdle
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("run() = %v, want %v", err, context.Canceled)
+	}
+	// Idle connections are replaced right away, whatever the retries limit
+	if len(*waits) != 0 || reconnects != 4 {
+		t.Errorf("waits = %v, reconnects = %d, want none and 4", *waits, reconnects)
+	}
+}
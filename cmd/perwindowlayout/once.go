@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// printOnce prints layout the daemon would switch the active window to,
+// along with the active layout, and returns.
+func printOnce(ctx context.Context, opts *options, w io.Writer) error {
+	client, clientClose, err := connect(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer clientClose()
+
+	res, err := opts.daemon.ActiveWindowLayout(ctx, client)
+	if err != nil {
+		return err
+	}
+	if res.Window == nil {
+		fmt.Fprintln(w, "No active window")
+		return nil
+	}
+	fmt.Fprintf(w, "Window: %s (%s)\n", res.Window.Class, res.Window.Address)
+	fmt.Fprintf(w, "Layout: %d %s\n", res.Layout, res.Layouts[res.Layout])
+	if res.Active >= 0 {
+		fmt.Fprintf(w, "Active: %d %s\n", res.Active, res.Layouts[res.Active])
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"perwindowlayout"
+	"perwindowlayout/hypr"
+)
+
+// replay processes events recorded in the file the way the daemon would,
+// without switching layouts or touching the state. Layouts can't be detected
+// then, so they must be given with -layouts or in config.
+func replay(ctx context.Context, path string, timing bool, opts *options, daemonOpts perwindowlayout.Options) error {
+	cfg := opts.daemon.Config()
+	names := cfg.Layouts
+	if len(opts.layouts) > 0 {
+		names = opts.layouts
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("replay needs layouts, set them with -layouts or layouts config option")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open replay: %w", err)
+	}
+	defer f.Close()
+	client, err := hypr.NewReplay(f, hypr.Layouts{Keyboard: cfg.Keyboard(), Names: names, Active: -1}, timing)
+	if err != nil {
+		return err
+	}
+	err = perwindowlayout.New(cfg, nil, daemonOpts).Run(ctx, client, nil)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// Build metadata, stamped by release builds with
+//
+//	-ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, buildDate)
+}
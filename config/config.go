@@ -0,0 +1,324 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"perwindowlayout/xdg"
+	"slices"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Layout references keyboard layout either by its index in kb_layout or by
+// its keymap name, like "English (US)".
+type Layout struct {
+	Index int
+	Name  string
+}
+
+func (l *Layout) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case int64:
+		l.Index = int(v)
+	case string:
+		l.Name = v
+	default:
+		return fmt.Errorf("layout should be either index or name, got %v", v)
+	}
+	return nil
+}
+
+func (l Layout) String() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return fmt.Sprint(l.Index)
+}
+
+type Config struct {
+	DefaultLayout Layout `toml:"default_layout"`
+	Rules         []Rule `toml:"rules"`
+	// Ignore are window classes to never switch layout for, glob patterns
+	// are allowed
+	Ignore []string `toml:"ignore"`
+	// ForceDefaultOnOpen makes new windows always start with the configured
+	// layout, instead of the one learned for the same app before
+	ForceDefaultOnOpen bool `toml:"force_default_on_open"`
+	// Workspaces are default layouts by workspace name, used for windows
+	// without matching rule
+	Workspaces map[string]Layout `toml:"workspaces"`
+	// Monitors are default layouts by monitor name, used for windows
+	// without matching rule or workspace default
+	Monitors map[string]Layout `toml:"monitors"`
+	// Allowed restricts windows of the class, glob patterns are allowed, to
+	// the layouts. Switching by hand to another layout snaps back to the
+	// next allowed one in the direction of the switch, unless switching is
+	// paused.
+	Allowed map[string][]Layout `toml:"allowed"`
+	// Keyboards are devices switched on focus change, only the detected
+	// keyboard by default. Other keyboards are left alone.
+	Keyboards []string `toml:"keyboards"`
+	// Mirror are devices switched to the same layout index whenever the
+	// main keyboard layout changes, by the daemon or by hand
+	Mirror []string `toml:"mirror"`
+	// Layouts are keymap names in the kb_layout order, when set layouts are
+	// not detected on startup
+	Layouts []string `toml:"layouts"`
+	// KeyboardName is the keyboard to manage, the main one by default
+	KeyboardName string `toml:"keyboard_name"`
+	// ManagedKeyboard is the only keyboard layouts are detected, followed
+	// and switched on. Unlike keyboard_name there is no falling back to the
+	// main keyboard, and keyboards option is ignored.
+	ManagedKeyboard string `toml:"managed_keyboard"`
+	// MaxWindows caps how many windows layouts are remembered for, least
+	// recently used are forgotten first. 4096 by default.
+	MaxWindows int `toml:"max_windows"`
+	// Debounce delays switching until focus stays on a window that long,
+	// so quickly skipped windows don't cause switching. Disabled by default.
+	Debounce time.Duration `toml:"debounce"`
+	// IdleTimeout is how long without events the connection is kept, it's
+	// set up again after that in case the event socket died silently, like
+	// after resume. Disabled by default.
+	IdleTimeout time.Duration `toml:"idle_timeout"`
+	// Notify shows desktop notification when layout is switched on focus
+	Notify bool `toml:"notify"`
+	// StateFile is where learned layouts are persisted between restarts
+	StateFile string `toml:"state_file"`
+	// StateKey is how windows are identified in persisted state:
+	// "class+title" (default) or "class"
+	StateKey string `toml:"state_key"`
+	// TrackBy is what layouts are remembered for: "window" (default) or
+	// "class", when all windows of an app share the layout
+	TrackBy string `toml:"track_by"`
+	// InvalidLayout is what to switch to when remembered layout doesn't
+	// exist anymore, after kb_layout was changed: "default" layout of the
+	// window (default) or "clamp" to the last one
+	InvalidLayout string `toml:"invalid_layout"`
+	// SwitchStrategy is how layouts are switched: by "index" (default) or
+	// by "cycle" through next/prev for xkb setups where groups don't map to
+	// indices. Only the tracked keyboard is cycled, other managed keyboards
+	// are switched by index. Learned layouts are kept as indices either way.
+	SwitchStrategy string `toml:"switch_strategy"`
+	// QueryLayout asks Hyprland for the active layout before switching, in
+	// case another tool changed it without the daemon noticing
+	QueryLayout bool `toml:"query_layout"`
+	// RestoreOnExit switches back to the layout active before the daemon
+	// started, when it's stopped
+	RestoreOnExit bool `toml:"restore_on_exit"`
+
+	// resolved is set once layouts were resolved, so conflicts are not
+	// warned about again on reconnects
+	resolved bool
+}
+
+func DefaultPath() string {
+	return xdg.ConfigFile("config.toml")
+}
+
+// Load reads the config from path. Missing file is not an error, empty config
+// is returned instead.
+func Load(path string) (*Config, error) {
+	cfg, errs := load(path)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// Check loads the config at path and reports all problems found, not just the
+// first one. Layout names are checked against layouts, unless it's empty.
+func Check(path string, layouts []string) []error {
+	cfg, errs := load(path)
+	if cfg == nil || len(layouts) == 0 {
+		return errs
+	}
+	layoutToIndex := make(map[string]int, len(layouts))
+	for i, l := range layouts {
+		layoutToIndex[l] = i
+	}
+	return append(errs, cfg.Resolve(layoutToIndex)...)
+}
+
+// load reads and validates the config, config is nil when it can't be read
+// at all.
+func load(path string) (*Config, []error) {
+	cfg := new(Config)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to read config %s: %w", path, err)}
+	}
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to parse config %s: %w", path, err)}
+	}
+	// Unknown keys are likely options of another version, not worth failing
+	for _, key := range md.Undecoded() {
+		slog.Warn(fmt.Sprintf("Unknown config key %s in %s, ignoring it", key, path))
+	}
+	var errs []error
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].compile(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid rule #%d in %s: %w", i+1, path, err))
+		}
+	}
+	if cfg.ManagedKeyboard != "" && cfg.KeyboardName != "" && cfg.ManagedKeyboard != cfg.KeyboardName {
+		errs = append(errs, fmt.Errorf("managed_keyboard %q and keyboard_name %q in %s conflict, set only one of them", cfg.ManagedKeyboard, cfg.KeyboardName, path))
+	}
+	if cfg.ManagedKeyboard != "" && len(cfg.Keyboards) > 0 {
+		slog.Warn(fmt.Sprintf("Keyboards option in %s is ignored, managed_keyboard is set", path))
+	}
+	switch cfg.TrackBy {
+	case "", "window", "class":
+	default:
+		errs = append(errs, fmt.Errorf("invalid track_by %q in %s, expected window or class", cfg.TrackBy, path))
+	}
+	switch cfg.SwitchStrategy {
+	case "", "index", "cycle":
+	default:
+		errs = append(errs, fmt.Errorf("invalid switch_strategy %q in %s, expected index or cycle", cfg.SwitchStrategy, path))
+	}
+	switch cfg.InvalidLayout {
+	case "", "default", "clamp":
+	default:
+		errs = append(errs, fmt.Errorf("invalid invalid_layout %q in %s, expected default or clamp", cfg.InvalidLayout, path))
+	}
+	return cfg, errs
+}
+
+// Resolve maps layout names used in config to indices of detected layouts.
+// Layouts with unknown names are marked with -1 index and ignored, they are
+// logged and returned as errors.
+func (c *Config) Resolve(layoutToIndex map[string]int) []error {
+	var errs []error
+	resolve := func(l *Layout, where string) {
+		if l.Name == "" {
+			return
+		}
+		idx, ok := layoutToIndex[l.Name]
+		if !ok {
+			err := fmt.Errorf("layout %q used in %s does not match any detected layout", l.Name, where)
+			slog.Warn(fmt.Sprintf("Ignoring config layout: %s", err))
+			errs = append(errs, err)
+			idx = -1
+		}
+		l.Index = idx
+	}
+	resolve(&c.DefaultLayout, "default_layout")
+	for i := range c.Rules {
+		resolve(&c.Rules[i].Layout, fmt.Sprintf("rule #%d", i+1))
+	}
+	for ws, l := range c.Workspaces {
+		resolve(&l, fmt.Sprintf("default for workspace %q", ws))
+		c.Workspaces[ws] = l
+	}
+	for mon, l := range c.Monitors {
+		resolve(&l, fmt.Sprintf("default for monitor %q", mon))
+		c.Monitors[mon] = l
+	}
+	for class, layouts := range c.Allowed {
+		for i := range layouts {
+			resolve(&layouts[i], fmt.Sprintf("allowed layouts of %q", class))
+		}
+	}
+	if !c.resolved {
+		warnConflicts(c.Rules)
+		c.resolved = true
+	}
+	return errs
+}
+
+// Clone returns a deep copy of the config, which can be resolved without
+// affecting readers of the original one.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Rules = slices.Clone(c.Rules)
+	clone.Ignore = slices.Clone(c.Ignore)
+	clone.Workspaces = maps.Clone(c.Workspaces)
+	clone.Monitors = maps.Clone(c.Monitors)
+	if c.Allowed != nil {
+		clone.Allowed = make(map[string][]Layout, len(c.Allowed))
+		for class, layouts := range c.Allowed {
+			clone.Allowed[class] = slices.Clone(layouts)
+		}
+	}
+	clone.Keyboards = slices.Clone(c.Keyboards)
+	clone.Mirror = slices.Clone(c.Mirror)
+	clone.Layouts = slices.Clone(c.Layouts)
+	return &clone
+}
+
+// Keyboard returns the keyboard to detect layouts on, empty for the main one.
+func (c *Config) Keyboard() string {
+	if c.ManagedKeyboard != "" {
+		return c.ManagedKeyboard
+	}
+	return c.KeyboardName
+}
+
+// AllowedFor returns indices of layouts windows of the class are restricted
+// to, nil when they are not. Exact class match goes before patterns.
+func (c *Config) AllowedFor(class string) []int {
+	layouts, ok := c.Allowed[class]
+	if !ok {
+		patterns := slices.Sorted(maps.Keys(c.Allowed))
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, class); matched {
+				layouts, ok = c.Allowed[pattern], true
+				break
+			}
+		}
+	}
+	var allowed []int
+	for _, l := range layouts {
+		if l.Index >= 0 {
+			allowed = append(allowed, l.Index)
+		}
+	}
+	return allowed
+}
+
+// Ignored reports whether windows of the class are left untouched.
+func (c *Config) Ignored(class string) bool {
+	for _, pattern := range c.Ignore {
+		if pattern == class {
+			return true
+		}
+		if ok, _ := path.Match(pattern, class); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// LayoutFor returns configured layout index for the window on the workspace
+// and monitor. The first one found wins:
+//
+//  1. rule matching title (and class, if it has one)
+//  2. rule matching class
+//  3. workspace default
+//  4. monitor default
+//  5. default_layout
+func (c *Config) LayoutFor(class, title, workspace, monitor string) int {
+	if r := c.MatchRule(class, title); r != nil {
+		return r.Layout.Index
+	}
+	if l, ok := c.Workspaces[workspace]; ok && l.Index >= 0 {
+		return l.Index
+	}
+	if l, ok := c.Monitors[monitor]; ok && l.Index >= 0 {
+		return l.Index
+	}
+	if c.DefaultLayout.Index < 0 {
+		return 0
+	}
+	return c.DefaultLayout.Index
+}
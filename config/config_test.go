@@ -0,0 +1,53 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadUnknownKeys(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	cfg := loadText(t, `
+# Comments are fine
+default_layout = "Russian" # at the end too
+from_the_future = true
+debounce = "150ms"
+ignore = ["steam"]
+
+[shiny]
+option = 1
+
+[[rules]]
+class = "kitty"
+layout = 2
+opacity = 0.9
+`)
+	if cfg.DefaultLayout.Name != "Russian" || cfg.Debounce != 150*time.Millisecond || !slices.Equal(cfg.Ignore, []string{"steam"}) {
+		t.Errorf("known keys are not loaded: %+v", cfg)
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].Class != "kitty" || cfg.Rules[0].Layout.Index != 2 {
+		t.Errorf("Rules = %+v, want the kitty one", cfg.Rules)
+	}
+	for _, key := range []string{"from_the_future", "shiny.option", "rules.opacity"} {
+		if !strings.Contains(logs.String(), "Unknown config key "+key) {
+			t.Errorf("unknown key %s is not warned about, logs:\n%s", key, logs.String())
+		}
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	cfg, err := Load(t.TempDir() + "/missing.toml")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Rules) != 0 || cfg.DefaultLayout != (Layout{}) {
+		t.Errorf("Load() = %+v, want empty config", cfg)
+	}
+}
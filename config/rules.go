@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+)
+
+// Rule assigns layout to matching windows. Class and Title are regular
+// expressions: Class has to match the whole window class, Title may match
+// any part of the title. Empty pattern matches any window.
+type Rule struct {
+	Class  string `toml:"class"`
+	Title  string `toml:"title"`
+	Layout Layout `toml:"layout"`
+	// Pin switches matching windows to the layout on every focus, layout
+	// changes in them are not remembered
+	Pin bool `toml:"pin_layout"`
+
+	class *regexp.Regexp
+	title *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if r.Class != "" {
+		if r.class, err = regexp.Compile("^(?:" + r.Class + ")$"); err != nil {
+			return fmt.Errorf("bad class pattern %q: %w", r.Class, err)
+		}
+	}
+	if r.Title != "" {
+		if r.title, err = regexp.Compile(r.Title); err != nil {
+			return fmt.Errorf("bad title pattern %q: %w", r.Title, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) Match(class, title string) bool {
+	if r.class != nil && !r.class.MatchString(class) {
+		return false
+	}
+	if r.title != nil && !r.title.MatchString(title) {
+		return false
+	}
+	return true
+}
+
+// PinnedLayout returns the layout of the window, if the rule matching it pins
+// one.
+func (c *Config) PinnedLayout(class, title string) (int, bool) {
+	if r := c.MatchRule(class, title); r != nil && r.Pin {
+		return r.Layout.Index, true
+	}
+	return 0, false
+}
+
+// warnConflicts logs rules which match the same windows with different
+// layouts, as only the first of them is ever used. Layouts are compared once
+// resolved, so index and name of the same layout don't conflict. Patterns
+// are compared as written, overlapping regular expressions are not detected.
+func warnConflicts(rules []Rule) {
+	for i := range rules {
+		for j := i + 1; j < len(rules); j++ {
+			a, b := rules[i], rules[j]
+			if a.Class != b.Class || a.Title != b.Title || a.Layout.Index < 0 || b.Layout.Index < 0 || a.Layout.Index == b.Layout.Index {
+				continue
+			}
+			slog.Warn(fmt.Sprintf("Rules #%d and #%d both match class %q with different layouts %s and %s, only the first one is used", i+1, j+1, a.Class, a.Layout, b.Layout))
+		}
+	}
+}
+
+// MatchRule returns the first rule matching the window, rules with title
+// pattern go before the ones matching by class only, as they are more
+// specific. Rules with layouts that could not be resolved are skipped.
+func (c *Config) MatchRule(class, title string) *Rule {
+	for _, byTitle := range []bool{true, false} {
+		for i := range c.Rules {
+			r := &c.Rules[i]
+			if (r.Title != "") == byTitle && r.Layout.Index >= 0 && r.Match(class, title) {
+				return r
+			}
+		}
+	}
+	return nil
+}
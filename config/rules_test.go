@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// loadText loads the config from the TOML text.
+func loadText(t *testing.T, text string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestMatchRule(t *testing.T) {
+	cfg := loadText(t, `
+[[rules]]
+class = "kitty"
+title = "^ssh .*prod"
+layout = 2
+
+[[rules]]
+title = "Telegram"
+layout = 1
+
+[[rules]]
+class = "kitty|foot"
+layout = 3
+
+[[rules]]
+class = "kitty"
+layout = 4
+
+[[rules]]
+title = "Telegram|Signal"
+layout = 5
+`)
+	tests := []struct {
+		class, title string
+		// want is the layout of the matching rule, -1 for no match
+		want int
+	}{
+		// Class only
+		{"foot", "zsh", 3},
+		{"kitty", "zsh", 3},
+		// Class has to match whole
+		{"kitty2", "zsh", -1},
+		// Title only, any part of it
+		{"org.telegram.desktop", "Telegram (3)", 1},
+		{"signal", "Signal", 5},
+		// Combined rule needs both
+		{"kitty", "ssh user@prod-db", 2},
+		{"foot", "ssh user@prod-db", 3},
+		{"kitty", "ssh user@staging", 3},
+		// Title rules go before class ones
+		{"kitty", "Telegram", 1},
+		{"kitty", "Signal", 5},
+		{"firefox", "Mozilla Firefox", -1},
+	}
+	for _, tt := range tests {
+		got := -1
+		if r := cfg.MatchRule(tt.class, tt.title); r != nil {
+			got = r.Layout.Index
+		}
+		if got != tt.want {
+			t.Errorf("MatchRule(%q, %q) has layout %d, want %d", tt.class, tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRuleSkipsUnresolved(t *testing.T) {
+	cfg := loadText(t, `
+[[rules]]
+class = "kitty"
+layout = "Klingon"
+
+[[rules]]
+class = "kitty"
+layout = "Russian"
+`)
+	cfg.Resolve(map[string]int{"English (US)": 0, "Russian": 1})
+	if r := cfg.MatchRule("kitty", "zsh"); r == nil || r.Layout.Index != 1 {
+		t.Errorf("MatchRule() = %+v, want the rule with Russian", r)
+	}
+}
+
+func TestWarnConflicts(t *testing.T) {
+	layoutToIndex := map[string]int{"English (US)": 0, "Russian": 1}
+	tests := []struct {
+		name  string
+		rules string
+		want  []string
+	}{
+		{
+			name:  "index and name of the same layout",
+			rules: "[[rules]]\nclass = \"kitty\"\nlayout = 1\n[[rules]]\nclass = \"kitty\"\nlayout = \"Russian\"",
+		},
+		{
+			name:  "index and name of different layouts",
+			rules: "[[rules]]\nclass = \"kitty\"\nlayout = 0\n[[rules]]\nclass = \"kitty\"\nlayout = \"Russian\"",
+			want:  []string{"Rules #1 and #2"},
+		},
+		{
+			name:  "names of different layouts",
+			rules: "[[rules]]\nclass = \"kitty\"\nlayout = \"English (US)\"\n[[rules]]\nclass = \"foot\"\nlayout = 0\n[[rules]]\nclass = \"kitty\"\nlayout = \"Russian\"",
+			want:  []string{"Rules #1 and #3"},
+		},
+		{
+			name:  "different titles",
+			rules: "[[rules]]\nclass = \"kitty\"\nlayout = 0\n[[rules]]\nclass = \"kitty\"\ntitle = \"ssh\"\nlayout = 1",
+		},
+		{
+			name:  "unknown layout",
+			rules: "[[rules]]\nclass = \"kitty\"\nlayout = 0\n[[rules]]\nclass = \"kitty\"\nlayout = \"Klingon\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadText(t, tt.rules)
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+			cfg.Resolve(layoutToIndex)
+			// Not again on reconnect
+			cfg.Clone().Resolve(layoutToIndex)
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if i := strings.Index(line, "Rules #"); i >= 0 {
+					got = append(got, line[i:i+len("Rules #1 and #2")])
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("conflicts = %q, want %q, logs:\n%s", got, tt.want, logs.String())
+			}
+		})
+	}
+}
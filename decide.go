@@ -0,0 +1,174 @@
+package perwindowlayout
+
+import (
+	"fmt"
+	"log/slog"
+	"perwindowlayout/config"
+	"perwindowlayout/hypr"
+	"slices"
+	"time"
+)
+
+// Action is a layout switch of a device the daemon decided to make.
+type Action struct {
+	Device string
+	// Layout is the layout switched to
+	Layout int
+	// Steps is how many times to switch to the next layout to get to Layout,
+	// negative for the previous one. It's 0 for switching by index.
+	Steps int
+}
+
+// switchPlan is the switch of the current window, which is decided on while
+// the event is handled and executed after.
+type switchPlan struct {
+	actions []Action
+	window  string
+	layout  int
+	// expected are activelayout events the switch will cause
+	expected []selfSwitch
+	// mirror plans follow the switch of the main keyboard, their errors
+	// are not fatal
+	mirror bool
+}
+
+// decide plans switching the current window to the layout, unless
+// switching is paused. t.mu must be held.
+func (t *tracker) decide(layout int) {
+	if t.daemon.Paused() {
+		slog.Debug(fmt.Sprintf("Paused, not switching layout to %s", t.layoutName(layout)), "window", t.currentWindowId)
+		return
+	}
+	if p := t.plan(layout); p != nil {
+		t.planned = append(t.planned, p)
+	}
+}
+
+// plan returns actions switching the current window to the layout, nil in dry
+// run. The activelayout events they cause are expected from now on, as they
+// may come before the switch returns. t.mu must be held.
+func (t *tracker) plan(layout int) *switchPlan {
+	name := t.layoutName(layout)
+	if t.daemon.opts.DryRun {
+		slog.Info(fmt.Sprintf("Dry run, not switching layout to %s", name), "window", t.currentWindowId, "layout", layout)
+		return nil
+	}
+	p := &switchPlan{window: t.currentWindowId, layout: layout}
+	expected := []int{layout}
+	steps := t.cycleSteps(layout)
+	if steps != 0 {
+		// Each step emits activelayout of the layout passed by
+		expected = expected[:0]
+		n, dir := len(t.layouts), 1
+		if steps < 0 {
+			dir = -1
+		}
+		for i := 1; i <= steps*dir; i++ {
+			expected = append(expected, ((t.currentLayout+dir*i)%n+n)%n)
+		}
+	}
+	for _, kb := range t.managed {
+		a := Action{Device: kb, Layout: layout}
+		if kb == t.keyboard {
+			// Position in the cycle is known for the tracked keyboard
+			// only, the others are switched by index
+			a.Steps = steps
+		}
+		p.actions = append(p.actions, a)
+	}
+	now := t.now()
+	for _, l := range expected {
+		s := selfSwitch{window: t.currentWindowId, layout: l, at: now}
+		p.expected = append(p.expected, s)
+		t.selfSwitches = append(t.selfSwitches, s)
+	}
+	return p
+}
+
+// execute makes the planned switch, t.mu must be held.
+func (t *tracker) execute(p *switchPlan) error {
+	if p == nil {
+		return nil
+	}
+	if p.mirror {
+		for _, a := range p.actions {
+			if err := t.do(a); err != nil {
+				slog.Warn(fmt.Sprintf("Could not mirror layout to %s: %s", a.Device, err))
+			}
+		}
+		return nil
+	}
+	name := t.layoutName(p.layout)
+	slog.Debug(fmt.Sprintf("Switching layout to %s", name), "window", p.window, "layout", p.layout)
+	for _, a := range p.actions {
+		if err := t.do(a); err != nil {
+			t.selfSwitches = slices.DeleteFunc(t.selfSwitches, func(s selfSwitch) bool {
+				return slices.Contains(p.expected, s)
+			})
+			t.daemon.metrics.switchErrors.Add(1)
+			return fmt.Errorf("failed to activate layout on %s: %w", a.Device, err)
+		}
+	}
+	t.daemon.metrics.switches.Add(1)
+	t.queriedAt = time.Time{}
+	if (t.daemon.opts.Notify || t.daemon.cfg.Load().Notify) && name != "" {
+		notifyLayout(name)
+	}
+	return nil
+}
+
+func (t *tracker) do(a Action) error {
+	if a.Steps == 0 {
+		return t.client.SwitchXKBLayout(a.Device, a.Layout)
+	}
+	steps, next := a.Steps, true
+	if steps < 0 {
+		steps, next = -steps, false
+	}
+	for range steps {
+		if err := t.client.CycleXKBLayout(a.Device, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executePlanned makes the switches planned while handling events.
+func (t *tracker) executePlanned() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	planned := t.planned
+	t.planned = nil
+	for _, p := range planned {
+		if err := t.execute(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decide returns switches the daemon would make processing the events, with
+// the layouts detected before. Nothing is read from or sent to Hyprland, so
+// debounce and query_layout are ignored and switches are taken as made right
+// away. Time doesn't pass between events either, so the result depends on
+// the arguments only, cfg is left as is.
+func Decide(cfg *config.Config, layouts hypr.Layouts, events []hypr.Event) []Action {
+	pure := cfg.Clone()
+	pure.Debounce, pure.QueryLayout = 0, false
+	d := New(pure, nil, Options{})
+	t := newTracker(d, nil, &layouts)
+	pure.Resolve(t.layoutToIndex)
+	t.now = func() time.Time { return time.Time{} }
+	var actions []Action
+	for _, evt := range events {
+		t.handle(evt)
+		for _, p := range t.planned {
+			actions = append(actions, p.actions...)
+			if !p.mirror {
+				t.currentLayout = p.layout
+			}
+		}
+		t.planned = nil
+	}
+	return actions
+}
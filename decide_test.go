@@ -0,0 +1,112 @@
+package perwindowlayout
+
+import (
+	"perwindowlayout/hypr"
+	"perwindowlayout/hypr/hyprtest"
+	"slices"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	open := func(addr, class string) hypr.Event {
+		return hyprtest.Event("openwindow", addr+",1,"+class+",title")
+	}
+	focus := func(addr string) hypr.Event {
+		return hyprtest.Event("activewindowv2", addr)
+	}
+	layout := func(name string) hypr.Event {
+		return hyprtest.Event("activelayout", "kb,"+name)
+	}
+	tests := []struct {
+		name   string
+		config string
+		// keyboards are detected besides the main one
+		keyboards []string
+		events    []hypr.Event
+		want      []Action
+	}{
+		{
+			name:   "rule",
+			config: "[[rules]]\nclass = \"kitty\"\nlayout = \"Russian\"",
+			events: []hypr.Event{open("a1", "kitty"), focus("a1")},
+			want:   []Action{{Device: "kb", Layout: 1}},
+		},
+		{
+			name:   "already active",
+			config: "default_layout = \"English (US)\"",
+			events: []hypr.Event{open("a1", "kitty"), focus("a1")},
+		},
+		{
+			name:   "chosen by hand",
+			config: "",
+			events: []hypr.Event{
+				open("a1", "kitty"), open("b2", "firefox"),
+				focus("a1"), layout("German"),
+				focus("b2"), focus("a1"),
+			},
+			want: []Action{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 2}},
+		},
+		{
+			name:   "own switch is not chosen by hand",
+			config: "[[rules]]\nclass = \"kitty\"\nlayout = \"Russian\"",
+			events: []hypr.Event{
+				open("a1", "kitty"), open("b2", "firefox"),
+				focus("a1"), layout("Russian"),
+				focus("b2"), focus("a1"),
+			},
+			want: []Action{{Device: "kb", Layout: 1}, {Device: "kb", Layout: 0}, {Device: "kb", Layout: 1}},
+		},
+		{
+			name:   "ignored",
+			config: "default_layout = 2\nignore = [\"kitty\"]",
+			events: []hypr.Event{open("a1", "kitty"), focus("a1")},
+		},
+		{
+			name:   "cycle",
+			config: "default_layout = 2\nswitch_strategy = \"cycle\"",
+			events: []hypr.Event{open("a1", "kitty"), focus("a1")},
+			want:   []Action{{Device: "kb", Layout: 2, Steps: -1}},
+		},
+		{
+			name:      "cycle other keyboards by index",
+			config:    "default_layout = 2\nswitch_strategy = \"cycle\"\nkeyboards = [\"kb\", \"ext\"]",
+			keyboards: []string{"ext"},
+			events:    []hypr.Event{open("a1", "kitty"), focus("a1")},
+			want:      []Action{{Device: "kb", Layout: 2, Steps: -1}, {Device: "ext", Layout: 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layouts := testLayouts
+			layouts.Keyboards = append([]string{"kb"}, tt.keyboards...)
+			got := Decide(loadConfig(t, tt.config), layouts, tt.events)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Decide() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecideLeavesConfig(t *testing.T) {
+	cfg := loadConfig(t, `
+default_layout = "German"
+
+[workspaces]
+"1" = "Russian"
+
+[[rules]]
+class = "kitty"
+layout = "Russian"
+`)
+	events := []hypr.Event{
+		hyprtest.Event("openwindow", "a1,1,kitty,zsh"),
+		hyprtest.Event("activewindowv2", "a1"),
+	}
+	first := Decide(cfg, testLayouts, events)
+	if cfg.DefaultLayout.Index != 0 || cfg.Rules[0].Layout.Index != 0 || cfg.Workspaces["1"].Index != 0 {
+		t.Errorf("config is resolved in place: %+v", cfg)
+	}
+	if again := Decide(cfg, testLayouts, events); !slices.Equal(first, again) {
+		t.Errorf("Decide() = %v the second time, was %v", again, first)
+	}
+}
@@ -1,3 +1,8 @@
 module perwindowlayout
 
 go 1.23.2
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/godbus/dbus/v5 v5.1.0
+)
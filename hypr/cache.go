@@ -0,0 +1,58 @@
+package hypr
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// layoutCacheVersion is bumped on incompatible changes of layoutCache, caches
+// of other versions are ignored.
+const layoutCacheVersion = 2
+
+// layoutCache remembers detected keymap names, so the layouts don't have to be
+// cycled on every start. It's valid only for the kb_layout and kb_variant it
+// was built for.
+type layoutCache struct {
+	Version   int      `json:"version"`
+	KbLayout  string   `json:"kb_layout"`
+	KbVariant string   `json:"kb_variant"`
+	Names     []string `json:"names"`
+}
+
+func loadLayoutCache(path, kbLayout, kbVariant string) ([]string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var cache layoutCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, false
+	}
+	if cache.Version != layoutCacheVersion || cache.KbLayout != kbLayout || cache.KbVariant != kbVariant || slices.Contains(cache.Names, "") {
+		return nil, false
+	}
+	return cache.Names, true
+}
+
+func saveLayoutCache(path, kbLayout, kbVariant string, names []string) error {
+	data, err := json.Marshal(layoutCache{
+		Version:   layoutCacheVersion,
+		KbLayout:  kbLayout,
+		KbVariant: kbVariant,
+		Names:     names,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal layout cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create layout cache dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write layout cache %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,56 @@
+package hypr_test
+
+import (
+	"context"
+	"perwindowlayout/hypr"
+	"perwindowlayout/hypr/hyprtest"
+	"slices"
+	"testing"
+)
+
+func TestClientOverSockets(t *testing.T) {
+	srv, err := hyprtest.NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client, closeClient, err := hypr.NewClient(context.Background(), hypr.WithSocketDir(srv.Dir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeClient()
+
+	srv.WaitClient()
+	err = srv.Send(
+		"openwindow>>a1b2c3,2,kitty,foo, bar",
+		"activewindowv2>>a1b2c3",
+		"activelayout>>kb,Russian",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name   string
+		fields []string
+	}{
+		{"openwindow", []string{"a1b2c3", "2", "kitty", "foo, bar"}},
+		{"activewindowv2", []string{"a1b2c3"}},
+		{"activelayout", []string{"kb", "Russian"}},
+	}
+	for _, w := range want {
+		evt, err := client.ReadEvent(context.Background())
+		if err != nil {
+			t.Fatalf("ReadEvent() error = %v", err)
+		}
+		if evt.Name != w.name || !slices.Equal(evt.Fields(), w.fields) {
+			t.Errorf("ReadEvent() = %s %q, want %s %q", evt.Name, evt.Fields(), w.name, w.fields)
+		}
+	}
+
+	if err := client.SwitchXKBLayout("kb", 1); err != nil {
+		t.Fatalf("SwitchXKBLayout() error = %v", err)
+	}
+	if got, want := srv.Commands(), []string{"switchxkblayout kb 1"}; !slices.Equal(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
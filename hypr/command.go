@@ -0,0 +1,118 @@
+package hypr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// errRejected is returned when Hyprland replied with an error, retrying the
+// same command won't help then.
+var errRejected = fmt.Errorf("hyprland replied")
+
+// commandClient sends requests to the Hyprland command socket, .socket.sock,
+// which serves a single request per connection. When the socket can't be
+// connected, it falls back to running hyprctl with the same arguments.
+type commandClient struct {
+	path string
+	dial dialFunc
+}
+
+// request sends command and returns the whole reply. asJSON asks Hyprland to
+// reply in JSON, like hyprctl -j does.
+func (cc *commandClient) request(ctx context.Context, asJSON bool, args ...string) ([]byte, error) {
+	conn, err := cc.dial(ctx, cc.path)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Debug("Command socket unavailable, falling back to hyprctl", "err", err)
+		return cc.hyprctl(ctx, asJSON, args...)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	cmd := strings.Join(args, " ")
+	if asJSON {
+		cmd = "j/" + cmd
+	}
+	if _, err := io.WriteString(conn, cmd); err != nil {
+		return nil, fmt.Errorf("failed to write to socket.sock: %w", err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply from socket.sock: %w", err)
+	}
+	return reply, nil
+}
+
+func (cc *commandClient) hyprctl(ctx context.Context, asJSON bool, args ...string) ([]byte, error) {
+	if asJSON {
+		args = append(args[:len(args):len(args)], "-j")
+	}
+	bin, err := exec.LookPath("hyprctl")
+	if err != nil {
+		return nil, errHyprctlNotFound(err)
+	}
+	out, err := exec.CommandContext(ctx, bin, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			// Exit status alone doesn't tell why hyprctl failed
+			return nil, fmt.Errorf("failed to execute hyprctl %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("failed to execute hyprctl %s: %w", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+// checkFallback warns on startup when the command socket is missing and
+// hyprctl, used instead of it, can't be found either.
+func (cc *commandClient) checkFallback() {
+	if _, err := os.Stat(cc.path); err == nil {
+		return
+	}
+	if _, err := exec.LookPath("hyprctl"); err != nil {
+		slog.Warn(fmt.Sprintf("Command socket %s is missing: %s", cc.path, errHyprctlNotFound(err)))
+	}
+}
+
+func errHyprctlNotFound(err error) error {
+	return fmt.Errorf("hyprctl is not found in PATH (%s), add the directory it's installed to to PATH of the service: %w", os.Getenv("PATH"), err)
+}
+
+// requestJSON sends command and decodes its JSON reply into v.
+func (cc *commandClient) requestJSON(ctx context.Context, v any, args ...string) error {
+	reply, err := cc.request(ctx, true, args...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(reply, v); err != nil {
+		return fmt.Errorf("failed to unmarshal hyprctl %s response: %w", args[0], err)
+	}
+	return nil
+}
+
+// requestOK sends command which replies "ok" on success, any other reply is
+// returned as error.
+func (cc *commandClient) requestOK(ctx context.Context, args ...string) error {
+	reply, err := cc.request(ctx, false, args...)
+	if err != nil {
+		return err
+	}
+	if resp := strings.TrimSpace(string(reply)); resp != "ok" {
+		return fmt.Errorf("%w to %s: %s", errRejected, strings.Join(args, " "), resp)
+	}
+	return nil
+}
@@ -2,7 +2,8 @@ package hypr
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -10,134 +11,630 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	ErrClosed = fmt.Errorf("clinet: closed")
+	ErrClosed      = fmt.Errorf("clinet: closed")
+	ErrNoKeyboards = fmt.Errorf("hyprland reported no keyboards")
+	// ErrNoInstance means there is no Hyprland to connect to, retrying
+	// won't help
+	ErrNoInstance = fmt.Errorf("no hyprland instance")
+	// ErrSocketUnavailable means Hyprland socket can't be connected, which
+	// may be temporary, e.g. while Hyprland restarts
+	ErrSocketUnavailable = fmt.Errorf("hyprland socket unavailable")
+	// ErrMalformedEvent is returned by ReadEvent for lines that can't be
+	// parsed. The connection is fine then, the line can be just skipped.
+	ErrMalformedEvent = fmt.Errorf("malformed event")
+	// ErrUnexpectedDevices means devices reply lacks fields layouts are
+	// detected from, likely hyprctl version this daemon doesn't support
+	ErrUnexpectedDevices = fmt.Errorf("unexpected hyprctl devices reply")
 )
 
 type Client struct {
-	closed bool
-	reader *textproto.Reader
+	closed   atomic.Bool
+	conn     net.Conn
+	reader   *textproto.Reader
+	commands *commandClient
+
+	// KeyboardName pins the keyboard layouts are detected and switched on,
+	// by default it's the main keyboard
+	KeyboardName string
+	// KnownLayouts are user provided keymap names, when set ReadLayouts uses
+	// them instead of detecting
+	KnownLayouts []string
+	// LayoutCachePath is where ReadLayouts caches detected keymap names, empty
+	// disables the cache
+	LayoutCachePath string
+	// Recorder gets every line read from the event socket, if set
+	Recorder *Recorder
 }
 
 type Event struct {
 	Name string
+	// Data is raw event payload, everything after ">>"
+	Data string
 	Args []string
 }
 
+// eventArity is amount of fields in payload of events we know about. The last
+// field of such events may contain commas (window titles, for example).
+var eventArity = map[string]int{
+	"activewindow":   2,
+	"activewindowv2": 1,
+	"activelayout":   2,
+	"activespecial":  2,
+	"openwindow":     4,
+	"closewindow":    1,
+	"windowtitle":    1,
+	"windowtitlev2":  2,
+	"workspace":      1,
+	"workspacev2":    2,
+	"focusedmon":     2,
+	"movewindow":     2,
+	"movewindowv2":   3,
+	"fullscreen":     1,
+	"openlayer":      1,
+	"closelayer":     1,
+}
+
+// Fields splits event payload respecting the known arity of the event, so the
+// commas inside the last field are preserved. For unknown events it's the
+// same as Args.
+func (e Event) Fields() []string {
+	n, known := eventArity[e.Name]
+	if !known {
+		return e.Args
+	}
+	fields := strings.SplitN(e.Data, ",", n)
+	for len(fields) < n {
+		fields = append(fields, "")
+	}
+	return fields
+}
+
 type Keyboard struct {
 	Layout       string `json:"layout"`
+	Variant      string `json:"variant"`
 	ActiveKeymap string `json:"active_keymap"`
 	Main         bool   `json:"main"`
 	Name         string `json:"name"`
+	// ActiveLayoutIndex is reported by newer Hyprland versions only
+	ActiveLayoutIndex *int `json:"active_layout_index"`
 }
 
 type DevicesResponse struct {
 	Keyboards []Keyboard `json:"keyboards"`
 }
 
-func NewClient() (*Client, func(), error) {
-	hs := new(Client)
+// SocketDirEnv overrides the directory with Hyprland sockets entirely.
+const SocketDirEnv = "PER_WINDOW_LAYOUT_SOCKET_DIR"
+
+// findSocketDir finds the directory of the running Hyprland instance sockets. It
+// is $XDG_RUNTIME_DIR/hypr/<signature>, or /run/user/<uid>/hypr/<signature>
+// when XDG_RUNTIME_DIR is not set.
+func findSocketDir() (string, error) {
+	if dir, ok := os.LookupEnv(SocketDirEnv); ok && dir != "" {
+		return dir, nil
+	}
 	sign, exists := os.LookupEnv("HYPRLAND_INSTANCE_SIGNATURE")
 	if !exists {
-		return nil, nil, fmt.Errorf("do you have Hyprland instance launched?")
+		return "", fmt.Errorf("%w: HYPRLAND_INSTANCE_SIGNATURE is not set, do you have Hyprland instance launched?", ErrNoInstance)
 	}
-	currentUser, err := user.Current()
+	return instanceDir(sign)
+}
+
+// hyprDir is the directory with sockets directories of all instances.
+func hyprDir() (string, error) {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return "", fmt.Errorf("don't know who are you: %w", err)
+		}
+		runtimeDir = fmt.Sprintf("/run/user/%s", currentUser.Uid)
+	}
+	return filepath.Join(runtimeDir, "hypr"), nil
+}
+
+func instanceDir(signature string) (string, error) {
+	dir, err := hyprDir()
 	if err != nil {
-		return nil, nil, fmt.Errorf("don't know who are you: %w", err)
+		return "", err
+	}
+	return filepath.Join(dir, signature), nil
+}
+
+// ListInstances returns signatures of Hyprland instances which have sockets
+// directory, including the ones left by crashed instances.
+func ListInstances() ([]string, error) {
+	dir, err := hyprDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	var instances []string
+	for _, e := range entries {
+		if e.IsDir() {
+			instances = append(instances, e.Name())
+		}
+	}
+	return instances, nil
+}
+
+// instancesHint lists instance directories next to the one of socketPath, to
+// help spotting stale HYPRLAND_INSTANCE_SIGNATURE.
+func instancesHint(socketPath string) string {
+	instanceDir := filepath.Dir(socketPath)
+	if filepath.Base(filepath.Dir(instanceDir)) != "hypr" {
+		// Socket dir is overridden, it's not one of the instances
+		return ""
+	}
+	entries, err := os.ReadDir(filepath.Dir(instanceDir))
+	if err != nil {
+		return ""
+	}
+	var instances []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != filepath.Base(instanceDir) {
+			instances = append(instances, e.Name())
+		}
+	}
+	if len(instances) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (running instances might be %s, is HYPRLAND_INSTANCE_SIGNATURE stale?)", strings.Join(instances, ", "))
+}
+
+// Option customizes NewClient.
+type Option func(*clientOptions)
+
+type clientOptions struct {
+	socketDir  string
+	socketPath string
+	instance   string
+	dial       dialFunc
+}
+
+type dialFunc func(ctx context.Context, path string) (net.Conn, error)
+
+// WithSocketDir makes client use Hyprland sockets in dir instead of looking
+// for the running instance.
+func WithSocketDir(dir string) Option {
+	return func(o *clientOptions) {
+		o.socketDir = dir
+	}
+}
+
+// WithInstance connects to Hyprland instance with the signature, instead of
+// the one from HYPRLAND_INSTANCE_SIGNATURE.
+func WithInstance(signature string) Option {
+	return func(o *clientOptions) {
+		o.instance = signature
+	}
+}
+
+// WithSocketPath sets path of the event socket, .socket2.sock. The command
+// socket is expected next to it.
+func WithSocketPath(path string) Option {
+	return func(o *clientOptions) {
+		o.socketPath = path
 	}
+}
+
+// WithDialer replaces the way sockets are connected, net.Dial("unix", path)
+// by default.
+func WithDialer(dial func(path string) (net.Conn, error)) Option {
+	return func(o *clientOptions) {
+		o.dial = func(_ context.Context, path string) (net.Conn, error) {
+			return dial(path)
+		}
+	}
+}
+
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
 
-	socketPath := fmt.Sprintf("/run/user/%s/hypr/%s/.socket2.sock", currentUser.Uid, sign)
-	sock, err := net.Dial("unix", socketPath)
+// NewClient connects to Hyprland event socket, ctx bounds only the connection
+// attempt.
+func NewClient(ctx context.Context, opts ...Option) (*Client, func(), error) {
+	o := clientOptions{dial: dialUnix}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	hs := new(Client)
+	socketPath := o.socketPath
+	if socketPath == "" {
+		socketDir := o.socketDir
+		var err error
+		switch {
+		case socketDir != "":
+		case o.instance != "":
+			socketDir, err = instanceDir(o.instance)
+		default:
+			socketDir, err = findSocketDir()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		socketPath = filepath.Join(socketDir, ".socket2.sock")
+	}
+	hs.commands = &commandClient{
+		path: filepath.Join(filepath.Dir(socketPath), ".socket.sock"),
+		dial: o.dial,
+	}
+	hs.commands.checkFallback()
+
+	sock, err := o.dial(ctx, socketPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("can't connect to Hyprland event socket: %w.", err)
+		return nil, nil, fmt.Errorf("%w: can't connect to Hyprland event socket %s%s: %w", ErrSocketUnavailable, socketPath, instancesHint(socketPath), err)
 	}
 
+	hs.conn = sock
 	hs.reader = textproto.NewReader(bufio.NewReader(sock))
+	var once sync.Once
 	return hs, func() {
-		hs.closed = true
-		sock.Close()
+		once.Do(func() {
+			hs.closed.Store(true)
+			sock.Close()
+		})
 	}, nil
 }
 
-func (c *Client) ReadEvent() (Event, error) {
-	if c.closed {
+// ReadEvent blocks until the next event, cancelling ctx unblocks it.
+func (c *Client) ReadEvent(ctx context.Context) (Event, error) {
+	if c.closed.Load() {
 		return Event{}, ErrClosed
 	}
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
 	data, err := c.reader.ReadLine()
+	if ctx.Err() != nil {
+		return Event{}, ctx.Err()
+	}
 	if err != nil {
 		return Event{}, fmt.Errorf("failed to read from socket2.sock: %w", err)
 	}
-	evtParts := strings.Split(data, ">>")
-	if len(evtParts) == 0 {
-		return Event{}, fmt.Errorf("got event, but the format is unexpected")
+	if c.Recorder != nil {
+		c.Recorder.Record(data)
+	}
+	return parseEventLine(data)
+}
+
+// parseEventLine parses a socket2.sock line, like "activewindowv2>>a1b2c3".
+func parseEventLine(line string) (Event, error) {
+	evtParts := strings.SplitN(line, ">>", 2)
+	if len(evtParts) < 2 || evtParts[0] == "" {
+		return Event{}, fmt.Errorf("%w: %q", ErrMalformedEvent, line)
 	}
 	evt := Event{
 		Name: evtParts[0],
+		Data: evtParts[1],
 		Args: strings.Split(evtParts[1], ","),
 	}
 	return evt, nil
 }
 
-func (c *Client) SwitchXKBLayout(layoutIdx int) error {
-	cmd := exec.Command("hyprctl", "switchxkblayout", "all", strconv.Itoa(layoutIdx))
-	return cmd.Run()
+// SwitchXKBLayout activates layout on the keyboard with the given name, "all"
+// switches every keyboard.
+func (c *Client) SwitchXKBLayout(device string, layoutIdx int) error {
+	return c.switchXKBLayout(context.Background(), device, layoutIdx)
 }
 
-func (c *Client) ReadLayouts() ([]string, error) {
-	slog.Debug("Gathering layouts with Names")
-	cmd := exec.Command("hyprctl", "devices", "-j")
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute hyprctl: %w", err)
+// CycleXKBLayout switches the keyboard to the next layout, or the previous
+// one, wrapping around.
+func (c *Client) CycleXKBLayout(device string, next bool) error {
+	target := "prev"
+	if next {
+		target = "next"
+	}
+	return c.switchXKBLayoutTo(context.Background(), device, target)
+}
+
+// Switching fails for a moment while Hyprland reloads, so it's retried a few
+// times before giving up.
+const (
+	switchAttempts  = 3
+	switchRetryWait = 100 * time.Millisecond
+)
+
+func (c *Client) switchXKBLayout(ctx context.Context, device string, layoutIdx int) error {
+	return c.switchXKBLayoutTo(ctx, device, strconv.Itoa(layoutIdx))
+}
+
+// switchXKBLayoutTo switches to the target, which is layout index, next or
+// prev.
+func (c *Client) switchXKBLayoutTo(ctx context.Context, device string, target string) error {
+	for attempt := 1; ; attempt++ {
+		err := c.commands.requestOK(ctx, "switchxkblayout", device, target)
+		if err == nil {
+			return nil
+		}
+		// Missing hyprctl or refused command fail the same way next time
+		permanent := errors.Is(err, exec.ErrNotFound) || errors.Is(err, errRejected)
+		if permanent || attempt == switchAttempts || ctx.Err() != nil {
+			return fmt.Errorf("failed to switch layout of %s to %s after %d attempts: %w", device, target, attempt, err)
+		}
+		slog.Debug("Retrying layout switch", "attempt", attempt, "err", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to switch layout of %s to %s: %w", device, target, ctx.Err())
+		case <-time.After(switchRetryWait * time.Duration(attempt)):
+		}
+	}
+}
+
+// Layouts are keyboard layouts detected on the main keyboard.
+type Layouts struct {
+	// Keyboard is the name of the device layouts were detected on
+	Keyboard string
+	// Names are keymap names of layouts, in the kb_layout order
+	Names []string
+	// Shorts are kb_layout codes of layouts, like "us"
+	Shorts []string
+	// Keyboards are names of all keyboards Hyprland reported
+	Keyboards []string
+	// Active is index of the layout active before detection, -1 if unknown
+	Active int
+	// Switched are layouts detection switched the main keyboard to, in
+	// order. Hyprland reports each of them with activelayout.
+	Switched []int
+}
+
+// LayoutEntry describes a single layout, for structured output.
+type LayoutEntry struct {
+	Index int    `json:"index"`
+	Short string `json:"short"`
+	Name  string `json:"name"`
+	// Active marks the layout active before detection
+	Active bool `json:"active"`
+}
+
+// Entries returns a LayoutEntry per layout.
+func (l *Layouts) Entries() []LayoutEntry {
+	entries := make([]LayoutEntry, len(l.Names))
+	for i, name := range l.Names {
+		entries[i] = LayoutEntry{Index: i, Name: name, Active: i == l.Active}
+		if i < len(l.Shorts) {
+			entries[i].Short = l.Shorts[i]
+		}
 	}
+	return entries
+}
+
+func (c *Client) devices(ctx context.Context) (*DevicesResponse, error) {
 	var response DevicesResponse
-	if err := json.Unmarshal(out, &response); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal hyprctl response: %w", err)
+	if err := c.commands.requestJSON(ctx, &response, "devices"); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+type Workspace struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type Window struct {
+	Address   string    `json:"address"`
+	Class     string    `json:"class"`
+	Title     string    `json:"title"`
+	Workspace Workspace `json:"workspace"`
+}
+
+// ActiveWindow returns the focused window, nil if nothing is focused.
+func (c *Client) ActiveWindow() (*Window, error) {
+	var w Window
+	if err := c.commands.requestJSON(context.Background(), &w, "activewindow"); err != nil {
+		return nil, err
+	}
+	if w.Address == "" || w.Address == "0x0" {
+		return nil, nil
+	}
+	return &w, nil
+}
+
+// Clients returns all open windows.
+func (c *Client) Clients() ([]Window, error) {
+	var windows []Window
+	if err := c.commands.requestJSON(context.Background(), &windows, "clients"); err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+// ActiveKeymap returns name of the active keymap of the keyboard.
+func (c *Client) ActiveKeymap(device string) (string, error) {
+	response, err := c.devices(context.Background())
+	if err != nil {
+		return "", err
+	}
+	kb, ok := findKeyboard(response, device)
+	if !ok {
+		return "", fmt.Errorf("keyboard %s not found", device)
+	}
+	return kb.ActiveKeymap, nil
+}
+
+// pickKeyboard chooses the keyboard to manage: the configured one, the main
+// one, or just the first when Hyprland doesn't flag any as main.
+func (c *Client) pickKeyboard(response *DevicesResponse) Keyboard {
+	if c.KeyboardName != "" {
+		if kb, ok := findKeyboard(response, c.KeyboardName); ok {
+			slog.Info(fmt.Sprintf("Using configured keyboard %s", kb.Name))
+			return kb
+		}
+		slog.Warn(fmt.Sprintf("Configured keyboard %s not found, falling back to the main one", c.KeyboardName))
 	}
-	mainKb := response.Keyboards[0]
 	for _, kb := range response.Keyboards {
 		if kb.Main {
-			mainKb = kb
-			break
+			slog.Info(fmt.Sprintf("Using main keyboard %s", kb.Name))
+			return kb
+		}
+	}
+	kb := response.Keyboards[0]
+	slog.Warn(fmt.Sprintf("No keyboard is marked as main, using the first one: %s", kb.Name))
+	return kb
+}
+
+// checkKeyboard makes sure the fields layouts are detected from were decoded,
+// they are missing when hyprctl renamed them.
+func checkKeyboard(kb Keyboard) error {
+	var missing []string
+	if kb.Layout == "" {
+		missing = append(missing, "layout")
+	}
+	if kb.ActiveKeymap == "" {
+		missing = append(missing, "active_keymap")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: keyboard %s has no %s, is this hyprctl version supported?", ErrUnexpectedDevices, kb.Name, strings.Join(missing, " and "))
+	}
+	return nil
+}
+
+func findKeyboard(response *DevicesResponse, name string) (Keyboard, bool) {
+	for _, kb := range response.Keyboards {
+		if kb.Name == name {
+			return kb, true
 		}
 	}
+	return Keyboard{}, false
+}
+
+// ReadLayouts detects keymap names of the main keyboard layouts. Common xkb
+// layouts and variants are resolved from the bundled tables without any
+// switching. For the rest, Hyprland reports only the name of the active
+// keymap, so the only reliable way to get them is to switch to each of them,
+// which costs a switch and a devices request per layout and is visible to the
+// user. To keep it short, the active layout is not switched to when Hyprland
+// reports its index, and it's restored only when it wasn't the last one
+// switched to. Detected names are cached in LayoutCachePath, so the switching
+// happens only once per kb_layout and kb_variant.
+func (c *Client) ReadLayouts(ctx context.Context) (*Layouts, error) {
+	slog.Debug("Gathering layouts with Names")
+	response, err := c.devices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Keyboards) == 0 {
+		return nil, ErrNoKeyboards
+	}
+	mainKb := c.pickKeyboard(response)
+	if err := checkKeyboard(mainKb); err != nil {
+		return nil, err
+	}
+	layouts := &Layouts{Keyboard: mainKb.Name, Active: -1}
+	for _, kb := range response.Keyboards {
+		layouts.Keyboards = append(layouts.Keyboards, kb.Name)
+	}
 	layoutsShorts := strings.Split(mainKb.Layout, ",")
-	result := make([]string, len(layoutsShorts))
+	for _, short := range layoutsShorts {
+		layouts.Shorts = append(layouts.Shorts, strings.TrimSpace(short))
+	}
+	if len(c.KnownLayouts) > 0 {
+		if len(c.KnownLayouts) != len(layoutsShorts) {
+			slog.Warn(fmt.Sprintf("Configured %d layouts, but kb_layout %q has %d", len(c.KnownLayouts), mainKb.Layout, len(layoutsShorts)))
+		}
+		layouts.Names = c.KnownLayouts
+		layouts.Active = slices.Index(layouts.Names, mainKb.ActiveKeymap)
+		return layouts, nil
+	}
+	if len(layoutsShorts) == 1 {
+		// The only layout is the active one, nothing to detect
+		layouts.Names = []string{mainKb.ActiveKeymap}
+		layouts.Active = 0
+		return layouts, nil
+	}
+	if c.LayoutCachePath != "" {
+		if names, ok := loadLayoutCache(c.LayoutCachePath, mainKb.Layout, mainKb.Variant); ok && len(names) == len(layoutsShorts) {
+			slog.Debug("Using cached layout names", "kb_layout", mainKb.Layout, "kb_variant", mainKb.Variant)
+			layouts.Names = names
+			layouts.Active = slices.Index(names, mainKb.ActiveKeymap)
+			return layouts, nil
+		}
+	}
+	result := namesFromTable(mainKb.Layout, mainKb.Variant)
 	activeLayoutIdx := -1
+	if idx := mainKb.ActiveLayoutIndex; idx != nil && *idx >= 0 && *idx < len(result) {
+		activeLayoutIdx = *idx
+	} else if mainKb.ActiveKeymap != "" {
+		activeLayoutIdx = slices.Index(result, mainKb.ActiveKeymap)
+	}
+	// The table names the active layout differently
+	activeMismatch := activeLayoutIdx >= 0 && result[activeLayoutIdx] != "" && result[activeLayoutIdx] != mainKb.ActiveKeymap
+	// The table names all layouts, but none of them is the active one
+	noneUnresolved := activeLayoutIdx == -1 && !slices.Contains(result, "")
+	if activeMismatch || noneUnresolved {
+		// Active keymap not matching the table means the table doesn't
+		// match what this xkb reports, so cycling is more reliable then
+		slog.Debug("Bundled layout names don't match active keymap", "active_keymap", mainKb.ActiveKeymap)
+		result = make([]string, len(layoutsShorts))
+	}
+	if activeLayoutIdx >= 0 {
+		result[activeLayoutIdx] = mainKb.ActiveKeymap
+	}
+	if !slices.Contains(result, "") {
+		slog.Debug("Resolved layout names from the bundled table", "kb_layout", mainKb.Layout)
+		layouts.Names = result
+		layouts.Active = activeLayoutIdx
+		return layouts, nil
+	}
+	lastSwitched := activeLayoutIdx
 	for i, l := range layoutsShorts {
-		if err := c.SwitchXKBLayout(i); err != nil {
+		if result[i] != "" {
+			// Resolved from the table or active already
+			continue
+		}
+		if err := c.switchXKBLayout(ctx, mainKb.Name, i); err != nil {
 			return nil, fmt.Errorf("failed to switch to layout %s: %w", l, err)
 		}
-		cmd = exec.Command("hyprctl", "devices", "-j")
-		out, err := cmd.Output()
+		lastSwitched = i
+		layouts.Switched = append(layouts.Switched, i)
+		response, err := c.devices(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read layout %s full name: %w", l, err)
 		}
-		var response DevicesResponse
-		if err := json.Unmarshal(out, &response); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal devices info while fetching layout %s name: %w", l, err)
+		kb, ok := findKeyboard(response, mainKb.Name)
+		if !ok {
+			return nil, fmt.Errorf("keyboard %s disappeared while fetching layout %s name", mainKb.Name, l)
+		}
+		if activeLayoutIdx == -1 && kb.ActiveKeymap == mainKb.ActiveKeymap {
+			activeLayoutIdx = i
 		}
-		for _, kb := range response.Keyboards {
-			if kb.Main {
-				if kb.ActiveKeymap == mainKb.ActiveKeymap {
-					activeLayoutIdx = i
-				}
-				result[i] = kb.ActiveKeymap
-				break
-			}
+		result[i] = kb.ActiveKeymap
+	}
+	layouts.Names = result
+	layouts.Active = activeLayoutIdx
+	if c.LayoutCachePath != "" {
+		if err := saveLayoutCache(c.LayoutCachePath, mainKb.Layout, mainKb.Variant, result); err != nil {
+			slog.Warn(fmt.Sprintf("Could not cache layout names: %s", err))
 		}
 	}
 	if activeLayoutIdx == -1 {
 		// Just ignore that case?
 		slog.Warn("Before gathering information there was strange layout activated. Can't restore it")
-		return result, nil
+		return layouts, nil
+	}
+	if lastSwitched == activeLayoutIdx {
+		return layouts, nil
 	}
-	if err := c.SwitchXKBLayout(activeLayoutIdx); err != nil {
+	if err := c.switchXKBLayout(ctx, mainKb.Name, activeLayoutIdx); err != nil {
 		return nil, fmt.Errorf("failed to activate back layout that used before gathering: %w", err)
 	}
-	return result, nil
+	layouts.Switched = append(layouts.Switched, activeLayoutIdx)
+	return layouts, nil
 }
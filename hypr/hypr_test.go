@@ -0,0 +1,139 @@
+package hypr
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testClient returns client reading events from data.
+func testClient(data string) *Client {
+	return &Client{reader: textproto.NewReader(bufio.NewReader(strings.NewReader(data)))}
+}
+
+func TestParseEventLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		data   string
+		fields []string
+	}{
+		{
+			line:   "activewindowv2>>a1b2c3",
+			name:   "activewindowv2",
+			data:   "a1b2c3",
+			fields: []string{"a1b2c3"},
+		},
+		{
+			line:   "activewindow>>kitty,foo, bar, baz",
+			name:   "activewindow",
+			data:   "kitty,foo, bar, baz",
+			fields: []string{"kitty", "foo, bar, baz"},
+		},
+		{
+			line:   "openwindow>>a1b2c3,2,firefox,foo, bar, baz",
+			name:   "openwindow",
+			data:   "a1b2c3,2,firefox,foo, bar, baz",
+			fields: []string{"a1b2c3", "2", "firefox", "foo, bar, baz"},
+		},
+		{
+			line:   "openwindow>>a1b2c3,2,firefox,",
+			name:   "openwindow",
+			data:   "a1b2c3,2,firefox,",
+			fields: []string{"a1b2c3", "2", "firefox", ""},
+		},
+		{
+			line:   "windowtitlev2>>a1b2c3,>>, ok",
+			name:   "windowtitlev2",
+			data:   "a1b2c3,>>, ok",
+			fields: []string{"a1b2c3", ">>, ok"},
+		},
+		{
+			line:   "activelayout>>AT Translated Set 2 keyboard,English (US)",
+			name:   "activelayout",
+			data:   "AT Translated Set 2 keyboard,English (US)",
+			fields: []string{"AT Translated Set 2 keyboard", "English (US)"},
+		},
+		{
+			// Missing fields are empty
+			line:   "activewindow>>",
+			name:   "activewindow",
+			data:   "",
+			fields: []string{"", ""},
+		},
+		{
+			// Unknown events are split by every comma
+			line:   "custom>>a,b,c",
+			name:   "custom",
+			data:   "a,b,c",
+			fields: []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			evt, err := parseEventLine(tt.line)
+			if err != nil {
+				t.Fatalf("parseEventLine() error = %v", err)
+			}
+			if evt.Name != tt.name || evt.Data != tt.data {
+				t.Errorf("parseEventLine() = %q, %q, want %q, %q", evt.Name, evt.Data, tt.name, tt.data)
+			}
+			if got := evt.Fields(); !slices.Equal(got, tt.fields) {
+				t.Errorf("Fields() = %q, want %q", got, tt.fields)
+			}
+		})
+	}
+}
+
+func TestReadEventMalformed(t *testing.T) {
+	c := testClient("garbage\n>>no name\nactivewindowv2>>a1b2c3\n")
+	for _, line := range []string{"garbage", ">>no name"} {
+		if _, err := c.ReadEvent(context.Background()); !errors.Is(err, ErrMalformedEvent) {
+			t.Errorf("ReadEvent() of %q error = %v, want %v", line, err, ErrMalformedEvent)
+		}
+	}
+	evt, err := c.ReadEvent(context.Background())
+	if err != nil {
+		t.Fatalf("ReadEvent() after malformed events error = %v", err)
+	}
+	if evt.Name != "activewindowv2" || evt.Data != "a1b2c3" {
+		t.Errorf("ReadEvent() = %+v, want activewindowv2 of a1b2c3", evt)
+	}
+	if _, err := c.ReadEvent(context.Background()); errors.Is(err, ErrMalformedEvent) || err == nil {
+		t.Errorf("ReadEvent() at the end error = %v, want the connection one", err)
+	}
+}
+
+func FuzzReadEvent(f *testing.F) {
+	f.Add("")
+	f.Add("activewindowv2 a1b2c3")
+	f.Add("activewindowv2>>a1b2c3")
+	f.Add("openwindow>>a1b2c3,2,firefox,foo, bar, baz")
+	f.Add("activewindow>>kitty,foo, bar, baz")
+	f.Add("activelayout>>keyboard,English (US)")
+	f.Fuzz(func(t *testing.T, line string) {
+		evt, err := parseEventLine(line)
+		if errors.Is(err, ErrMalformedEvent) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("parseEventLine() error = %v", err)
+		}
+		if evt.Name == "" {
+			t.Errorf("parseEventLine() = %+v without name", evt)
+		}
+		if got := evt.Name + ">>" + evt.Data; got != line {
+			t.Errorf("parseEventLine() = %q, want %q", got, line)
+		}
+		if got := strings.Join(evt.Args, ","); got != evt.Data {
+			t.Errorf("Args = %q, want split %q", evt.Args, evt.Data)
+		}
+		if n, known := eventArity[evt.Name]; known && len(evt.Fields()) != n {
+			t.Errorf("Fields() = %q, want %d fields", evt.Fields(), n)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+// Package hyprtest provides a fake Hyprland client for testing code that
+// processes Hyprland events without a running Hyprland.
+package hyprtest
+
+import (
+	"context"
+	"io"
+	"perwindowlayout/hypr"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Switch is a recorded SwitchXKBLayout or CycleXKBLayout call.
+type Switch struct {
+	Device string
+	// Layout is the layout switched to
+	Layout int
+	// Step is "next" or "prev" for CycleXKBLayout calls
+	Step string
+}
+
+// Client replays the scripted events and records layout switches. When
+// events are over ReadEvent returns io.EOF.
+type Client struct {
+	// Window is returned by ActiveWindow
+	Window *hypr.Window
+	// Windows are returned by Clients
+	Windows []hypr.Window
+	// Echo makes SwitchXKBLayout of the main keyboard emit activelayout like
+	// Hyprland does, before the rest of the scripted events. ReadLayouts
+	// emits it for Layouts.Switched.
+	Echo bool
+
+	mu       sync.Mutex
+	events   []hypr.Event
+	layouts  hypr.Layouts
+	switches []Switch
+}
+
+func NewClient(layouts hypr.Layouts, events ...hypr.Event) *Client {
+	return &Client{layouts: layouts, events: events}
+}
+
+func (c *Client) ReadEvent(ctx context.Context) (hypr.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return hypr.Event{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.events) == 0 {
+		return hypr.Event{}, io.EOF
+	}
+	evt := c.events[0]
+	c.events = c.events[1:]
+	if evt.Name == "activelayout" {
+		// Scripted layout changes move the position CycleXKBLayout moves from
+		fields := evt.Fields()
+		if i := slices.Index(c.layouts.Names, fields[1]); fields[0] == c.layouts.Keyboard && i >= 0 {
+			c.layouts.Active = i
+		}
+	}
+	return evt, nil
+}
+
+func (c *Client) ReadLayouts(ctx context.Context) (*hypr.Layouts, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	layouts := c.layouts
+	if c.Echo {
+		var evts []hypr.Event
+		for _, i := range layouts.Switched {
+			evts = append(evts, Event("activelayout", layouts.Keyboard+","+layouts.Names[i]))
+		}
+		c.events = append(evts, c.events...)
+	}
+	return &layouts, nil
+}
+
+// SetLayouts changes layouts returned by ReadLayouts, like kb_layout change
+// does.
+func (c *Client) SetLayouts(layouts hypr.Layouts) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.layouts = layouts
+}
+
+func (c *Client) ActiveWindow() (*hypr.Window, error) {
+	return c.Window, nil
+}
+
+func (c *Client) Clients() ([]hypr.Window, error) {
+	return c.Windows, nil
+}
+
+func (c *Client) SwitchXKBLayout(device string, layoutIdx int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.switches = append(c.switches, Switch{Device: device, Layout: layoutIdx})
+	c.switched(device, layoutIdx)
+	return nil
+}
+
+// CycleXKBLayout moves from the active layout, which starts at
+// Layouts.Active.
+func (c *Client) CycleXKBLayout(device string, next bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.layouts.Names)
+	step, layout := "prev", (c.layouts.Active-1+n)%n
+	if next {
+		step, layout = "next", (c.layouts.Active+1)%n
+	}
+	c.switches = append(c.switches, Switch{Device: device, Layout: layout, Step: step})
+	c.switched(device, layout)
+	return nil
+}
+
+// switched updates the active layout, c.mu must be held.
+func (c *Client) switched(device string, layoutIdx int) {
+	if device != c.layouts.Keyboard || layoutIdx < 0 || layoutIdx >= len(c.layouts.Names) {
+		return
+	}
+	c.layouts.Active = layoutIdx
+	if c.Echo {
+		evt := Event("activelayout", device+","+c.layouts.Names[layoutIdx])
+		c.events = append([]hypr.Event{evt}, c.events...)
+	}
+}
+
+func (c *Client) ActiveKeymap(device string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.layouts.Active < 0 || c.layouts.Active >= len(c.layouts.Names) {
+		return "", nil
+	}
+	return c.layouts.Names[c.layouts.Active], nil
+}
+
+// Switches returns SwitchXKBLayout calls made so far.
+func (c *Client) Switches() []Switch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Switch(nil), c.switches...)
+}
+
+// Event builds event the way it comes from the socket, e.g.
+// Event("activewindowv2", "a1b2c3").
+func Event(name, data string) hypr.Event {
+	return hypr.Event{Name: name, Data: data, Args: strings.Split(data, ",")}
+}
@@ -0,0 +1,149 @@
+package hyprtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Server emulates Hyprland sockets in a directory: it sends scripted event
+// lines to clients of .socket2.sock and records commands sent to
+// .socket.sock. Use it with hypr.WithSocketDir(server.Dir()).
+type Server struct {
+	dir      string
+	events   net.Listener
+	commands net.Listener
+
+	// Devices is the reply to "j/devices" requests
+	Devices string
+	// Replies are replies to other commands, by the command text
+	Replies map[string]string
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	joined   chan struct{}
+	received []string
+}
+
+// NewServer starts listening in dir, which should be a fresh directory, like
+// the one from testing.T.TempDir.
+func NewServer(dir string) (*Server, error) {
+	s := &Server{dir: dir, Devices: `{"keyboards": []}`, joined: make(chan struct{}, 1)}
+	var err error
+	if s.events, err = net.Listen("unix", filepath.Join(dir, ".socket2.sock")); err != nil {
+		return nil, fmt.Errorf("failed to listen for events: %w", err)
+	}
+	if s.commands, err = net.Listen("unix", filepath.Join(dir, ".socket.sock")); err != nil {
+		s.events.Close()
+		return nil, fmt.Errorf("failed to listen for commands: %w", err)
+	}
+	go s.acceptEvents()
+	go s.acceptCommands()
+	return s, nil
+}
+
+func (s *Server) Dir() string {
+	return s.dir
+}
+
+func (s *Server) acceptEvents() {
+	for {
+		conn, err := s.events.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		select {
+		case s.joined <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Server) acceptCommands() {
+	for {
+		conn, err := s.commands.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveCommand(conn)
+	}
+}
+
+func (s *Server) serveCommand(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 8192)
+	n, err := conn.Read(buf)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return
+	}
+	cmd := string(buf[:n])
+	s.mu.Lock()
+	s.received = append(s.received, cmd)
+	devices := s.Devices
+	reply, scripted := s.Replies[cmd]
+	s.mu.Unlock()
+	switch {
+	case scripted:
+		io.WriteString(conn, reply)
+	case cmd == "j/devices":
+		io.WriteString(conn, devices)
+	case cmd == "j/activewindow":
+		io.WriteString(conn, "{}")
+	case strings.HasPrefix(cmd, "switchxkblayout "):
+		io.WriteString(conn, "ok")
+	default:
+		io.WriteString(conn, "unknown request")
+	}
+}
+
+// WaitClient blocks until a client connects to the event socket.
+func (s *Server) WaitClient() {
+	s.mu.Lock()
+	connected := len(s.conns) > 0
+	s.mu.Unlock()
+	if !connected {
+		<-s.joined
+	}
+}
+
+// Send writes event lines, like "activewindowv2>>a1b2c3", to every connected
+// client.
+func (s *Server) Send(lines ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		w := bufio.NewWriter(conn)
+		for _, line := range lines {
+			w.WriteString(line + "\n")
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("failed to send events: %w", err)
+		}
+	}
+	return nil
+}
+
+// Commands returns the commands received on the command socket so far.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+func (s *Server) Close() {
+	s.events.Close()
+	s.commands.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package hypr_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"perwindowlayout/hypr"
+	"perwindowlayout/hypr/hyprtest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// mainKeyboard is devices reply with the main keyboard of the kb_layout and
+// kb_variant.
+func mainKeyboard(kbLayout, kbVariant string) string {
+	return `{"keyboards": [{"name": "kb", "layout": "` + kbLayout + `", "variant": "` + kbVariant + `", "active_keymap": "English (US)", "main": true}]}`
+}
+
+// newServer starts fake Hyprland replying devices to "j/devices", and
+// connects to it.
+func newServer(tb testing.TB, devices string) (*hyprtest.Server, *hypr.Client) {
+	tb.Helper()
+	srv, err := hyprtest.NewServer(tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(srv.Close)
+	srv.Devices = devices
+	client, closeClient, err := hypr.NewClient(context.Background(), hypr.WithSocketDir(srv.Dir()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(closeClient)
+	return srv, client
+}
+
+func TestReadLayoutsFromTable(t *testing.T) {
+	srv, client := newServer(t, mainKeyboard("us,ru,de", ",phonetic,"))
+	layouts, err := client.ReadLayouts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"English (US)", "Russian (phonetic)", "German"}; !slices.Equal(layouts.Names, want) {
+		t.Errorf("Names = %q, want %q", layouts.Names, want)
+	}
+	if layouts.Keyboard != "kb" || layouts.Active != 0 || len(layouts.Switched) != 0 {
+		t.Errorf("ReadLayouts() = %+v, want kb with the first layout active, not switched", layouts)
+	}
+	for _, cmd := range srv.Commands() {
+		if strings.HasPrefix(cmd, "switchxkblayout ") {
+			t.Errorf("layouts from the table are switched to: %q", cmd)
+		}
+	}
+}
+
+func TestReadLayoutsUnexpectedDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices string
+		// unexpected is whether the error is ErrUnexpectedDevices, the
+		// parse one otherwise
+		unexpected bool
+	}{
+		{
+			name:       "renamed fields",
+			devices:    `{"keyboards": [{"name": "kb", "kb_layout": "us,ru", "keymap": "English (US)", "main": true}]}`,
+			unexpected: true,
+		},
+		{
+			name:       "renamed keymap",
+			devices:    `{"keyboards": [{"name": "kb", "layout": "us,ru", "keymap": "English (US)", "main": true}]}`,
+			unexpected: true,
+		},
+		{
+			name:       "nested",
+			devices:    `{"keyboards": [{"name": "kb", "xkb": {"layout": "us,ru", "active_keymap": "English (US)"}, "main": true}]}`,
+			unexpected: true,
+		},
+		{
+			name:    "truncated",
+			devices: `{"keyboards": [{"name": "kb", "layout": "us,ru", "active_ke`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newServer(t, tt.devices)
+			layouts, err := client.ReadLayouts(context.Background())
+			if err == nil {
+				t.Fatalf("ReadLayouts() = %+v, want error", layouts)
+			}
+			if got := errors.Is(err, hypr.ErrUnexpectedDevices); got != tt.unexpected {
+				t.Errorf("ReadLayouts() error = %v, ErrUnexpectedDevices is %t, want %t", err, got, tt.unexpected)
+			}
+		})
+	}
+}
+
+func BenchmarkReadLayouts(b *testing.B) {
+	for _, bench := range []struct {
+		name             string
+		layout, variants string
+	}{
+		// Resolved from the tables
+		{"table", "us,ru,de,fr", ""},
+		// Detected switching to each of them
+		{"switching", "us,xx,yy,zz", ""},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+			srv, client := newServer(b, mainKeyboard(bench.layout, bench.variants))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.ReadLayouts(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(srv.Commands()))/float64(b.N), "requests/op")
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package hypr
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recorder writes raw event lines with timestamps, the format Replay reads.
+// Writes are buffered, so recording doesn't slow the event loop down.
+type Recorder struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	fail bool
+}
+
+// NewRecorder appends recorded events to the file at path.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open record file: %w", err)
+	}
+	return &Recorder{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Record adds the raw line read at the moment.
+func (r *Recorder) Record(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail {
+		return
+	}
+	fmt.Fprintf(r.w, "%s\t%s\n", time.Now().Format(time.RFC3339Nano), line)
+}
+
+// Flush writes buffered lines to the file.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		// Keep the daemon going, just stop recording
+		r.fail = true
+		return fmt.Errorf("failed to write record file: %w", err)
+	}
+	return nil
+}
+
+// Close flushes buffered lines and closes the file.
+func (r *Recorder) Close() error {
+	if err := r.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,114 @@
+package hypr
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Replay plays back events recorded from the event socket instead of reading
+// them from Hyprland, for reproducing issues. Layout switches are logged
+// only. Each line is either a raw event line or a timestamp in RFC 3339
+// format followed by a tab and the raw line, as Recorder writes them.
+type Replay struct {
+	lines   []string
+	layouts Layouts
+	// timing makes ReadEvent wait as long as between the recorded events
+	timing bool
+	last   time.Time
+}
+
+// NewReplay reads the recorded events from r. When layouts.Keyboard is empty,
+// the keyboard of the first recorded activelayout event is used.
+func NewReplay(r io.Reader, layouts Layouts, timing bool) (*Replay, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	rp := &Replay{layouts: layouts, timing: timing}
+	for scanner.Scan() {
+		rp.lines = append(rp.lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read replay: %w", err)
+	}
+	if rp.layouts.Keyboard == "" {
+		for _, line := range rp.lines {
+			_, line = splitRecorded(line)
+			if evt, err := parseEventLine(line); err == nil && evt.Name == "activelayout" {
+				rp.layouts.Keyboard = evt.Fields()[0]
+				break
+			}
+		}
+	}
+	if rp.layouts.Keyboards == nil {
+		rp.layouts.Keyboards = []string{rp.layouts.Keyboard}
+	}
+	return rp, nil
+}
+
+// splitRecorded splits timestamp from the recorded line, it's zero when the
+// line has none.
+func splitRecorded(line string) (time.Time, string) {
+	stamp, raw, ok := strings.Cut(line, "\t")
+	if !ok {
+		return time.Time{}, line
+	}
+	at, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return time.Time{}, line
+	}
+	return at, raw
+}
+
+// ReadEvent returns the next recorded event, io.EOF when they are over.
+func (rp *Replay) ReadEvent(ctx context.Context) (Event, error) {
+	if len(rp.lines) == 0 {
+		return Event{}, io.EOF
+	}
+	at, line := splitRecorded(rp.lines[0])
+	rp.lines = rp.lines[1:]
+	if rp.timing && !at.IsZero() {
+		if !rp.last.IsZero() && at.After(rp.last) {
+			select {
+			case <-ctx.Done():
+				return Event{}, ctx.Err()
+			case <-time.After(at.Sub(rp.last)):
+			}
+		}
+		rp.last = at
+	}
+	return parseEventLine(line)
+}
+
+func (rp *Replay) ReadLayouts(ctx context.Context) (*Layouts, error) {
+	layouts := rp.layouts
+	return &layouts, nil
+}
+
+func (rp *Replay) ActiveWindow() (*Window, error) {
+	return nil, nil
+}
+
+func (rp *Replay) Clients() ([]Window, error) {
+	return nil, nil
+}
+
+func (rp *Replay) ActiveKeymap(device string) (string, error) {
+	if rp.layouts.Active < 0 || rp.layouts.Active >= len(rp.layouts.Names) {
+		return "", nil
+	}
+	return rp.layouts.Names[rp.layouts.Active], nil
+}
+
+func (rp *Replay) SwitchXKBLayout(device string, layoutIdx int) error {
+	slog.Info(fmt.Sprintf("Replay, not switching %s to layout %d", device, layoutIdx))
+	return nil
+}
+
+func (rp *Replay) CycleXKBLayout(device string, next bool) error {
+	slog.Info(fmt.Sprintf("Replay, not cycling %s layout", device), "next", next)
+	return nil
+}
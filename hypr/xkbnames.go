@@ -0,0 +1,93 @@
+package hypr
+
+import "strings"
+
+// xkbLayoutNames maps xkb layout codes to keymap names Hyprland reports as
+// active_keymap, for layouts without variant.
+var xkbLayoutNames = map[string]string{
+	"am":    "Armenian",
+	"ara":   "Arabic",
+	"at":    "German (Austria)",
+	"be":    "Belgian",
+	"bg":    "Bulgarian",
+	"br":    "Portuguese (Brazil)",
+	"by":    "Belarusian",
+	"ca":    "French (Canada)",
+	"ch":    "German (Switzerland)",
+	"cn":    "Chinese",
+	"cz":    "Czech",
+	"de":    "German",
+	"dk":    "Danish",
+	"ee":    "Estonian",
+	"es":    "Spanish",
+	"fi":    "Finnish",
+	"fr":    "French",
+	"gb":    "English (UK)",
+	"ge":    "Georgian",
+	"gr":    "Greek",
+	"hr":    "Croatian",
+	"hu":    "Hungarian",
+	"ie":    "Irish",
+	"il":    "Hebrew",
+	"in":    "Indian",
+	"ir":    "Persian",
+	"is":    "Icelandic",
+	"it":    "Italian",
+	"jp":    "Japanese",
+	"kr":    "Korean",
+	"kz":    "Kazakh",
+	"latam": "Spanish (Latin American)",
+	"lt":    "Lithuanian",
+	"lv":    "Latvian",
+	"nl":    "Dutch",
+	"no":    "Norwegian",
+	"pl":    "Polish",
+	"pt":    "Portuguese",
+	"ro":    "Romanian",
+	"rs":    "Serbian",
+	"ru":    "Russian",
+	"se":    "Swedish",
+	"si":    "Slovenian",
+	"sk":    "Slovak",
+	"th":    "Thai",
+	"tr":    "Turkish",
+	"ua":    "Ukrainian",
+	"us":    "English (US)",
+	"vn":    "Vietnamese",
+}
+
+// xkbVariantNames maps layout(variant) pairs of common variants to keymap
+// names.
+var xkbVariantNames = map[string]string{
+	"ca(multix)":     "Canadian (CSA)",
+	"cz(qwerty)":     "Czech (QWERTY)",
+	"de(nodeadkeys)": "German (no dead keys)",
+	"fr(azerty)":     "French (AZERTY)",
+	"fr(bepo)":       "French (BEPO)",
+	"gb(extd)":       "English (UK, extended, Windows)",
+	"pl(dvorak)":     "Polish (Dvorak)",
+	"ru(phonetic)":   "Russian (phonetic)",
+	"ua(phonetic)":   "Ukrainian (phonetic)",
+	"us(altgr-intl)": "English (intl., with AltGr dead keys)",
+	"us(colemak)":    "English (Colemak)",
+	"us(dvorak)":     "English (Dvorak)",
+	"us(intl)":       "English (US, intl., with dead keys)",
+	"us(workman)":    "English (Workman)",
+}
+
+// namesFromTable resolves keymap names of kb_layout/kb_variant pair without
+// switching layouts. Names of layouts missing from the tables are left empty.
+func namesFromTable(kbLayout, kbVariant string) []string {
+	layouts := strings.Split(kbLayout, ",")
+	variants := strings.Split(kbVariant, ",")
+	names := make([]string, len(layouts))
+	for i, l := range layouts {
+		l = strings.TrimSpace(l)
+		if i < len(variants) && strings.TrimSpace(variants[i]) != "" {
+			names[i] = xkbVariantNames[l+"("+strings.TrimSpace(variants[i])+")"]
+			continue
+		}
+		names[i] = xkbLayoutNames[l]
+	}
+	return names
+}
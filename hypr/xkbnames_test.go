@@ -0,0 +1,31 @@
+package hypr
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNamesFromTable(t *testing.T) {
+	tests := []struct {
+		layout, variant string
+		want            []string
+	}{
+		{"us", "", []string{"English (US)"}},
+		{"us,ru", "", []string{"English (US)", "Russian"}},
+		{"us, ru, de", "", []string{"English (US)", "Russian", "German"}},
+		{"gb,fr", ",", []string{"English (UK)", "French"}},
+		{"us,ru", "dvorak,", []string{"English (Dvorak)", "Russian"}},
+		{"us,ru", ",phonetic", []string{"English (US)", "Russian (phonetic)"}},
+		{"us,de", "intl, nodeadkeys", []string{"English (US, intl., with dead keys)", "German (no dead keys)"}},
+		// Fewer variants than layouts
+		{"us,ua,pl", "colemak", []string{"English (Colemak)", "Ukrainian", "Polish"}},
+		// Missing from the tables, left to be detected by switching
+		{"us,xx", "", []string{"English (US)", ""}},
+		{"us,de", ",neo", []string{"English (US)", ""}},
+	}
+	for _, tt := range tests {
+		if got := namesFromTable(tt.layout, tt.variant); !slices.Equal(got, tt.want) {
+			t.Errorf("namesFromTable(%q, %q) = %q, want %q", tt.layout, tt.variant, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package perwindowlayout
+
+import "container/list"
+
+const defaultMaxWindows = 4096
+
+// layoutLRU is window to layout map keeping at most size most recently used
+// windows, so windows missed by closewindow don't pile up forever.
+type layoutLRU struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+	// onEvict is called with windows dropped to keep the size, may be nil
+	onEvict func(window string)
+}
+
+type lruEntry struct {
+	window string
+	layout int
+}
+
+func newLayoutLRU(size int) *layoutLRU {
+	if size <= 0 {
+		size = defaultMaxWindows
+	}
+	return &layoutLRU{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *layoutLRU) Get(window string) (int, bool) {
+	el, ok := l.items[window]
+	if !ok {
+		return 0, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruEntry).layout, true
+}
+
+func (l *layoutLRU) Set(window string, layout int) {
+	if el, ok := l.items[window]; ok {
+		el.Value.(*lruEntry).layout = layout
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[window] = l.order.PushFront(&lruEntry{window: window, layout: layout})
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		window := oldest.Value.(*lruEntry).window
+		delete(l.items, window)
+		if l.onEvict != nil {
+			l.onEvict(window)
+		}
+	}
+}
+
+func (l *layoutLRU) Delete(window string) {
+	if el, ok := l.items[window]; ok {
+		l.order.Remove(el)
+		delete(l.items, window)
+	}
+}
+
+// Remap replaces layout of each window with the one f returns, windows f
+// returns false for are dropped.
+func (l *layoutLRU) Remap(f func(layout int) (int, bool)) {
+	for window, el := range l.items {
+		entry := el.Value.(*lruEntry)
+		layout, ok := f(entry.layout)
+		if !ok {
+			l.order.Remove(el)
+			delete(l.items, window)
+			continue
+		}
+		entry.layout = layout
+	}
+}
+
+// Has reports whether the window is kept, without marking it used.
+func (l *layoutLRU) Has(window string) bool {
+	_, ok := l.items[window]
+	return ok
+}
+
+func (l *layoutLRU) Len() int {
+	return l.order.Len()
+}
+
+// Map returns copy of the entries.
+func (l *layoutLRU) Map() map[string]int {
+	m := make(map[string]int, len(l.items))
+	for window, el := range l.items {
+		m[window] = el.Value.(*lruEntry).layout
+	}
+	return m
+}
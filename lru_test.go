@@ -0,0 +1,71 @@
+package perwindowlayout
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestLayoutLRU(t *testing.T) {
+	var evicted []string
+	l := newLayoutLRU(3)
+	l.onEvict = func(window string) {
+		evicted = append(evicted, window)
+	}
+	l.Set("a", 0)
+	l.Set("b", 1)
+	l.Set("c", 2)
+	if got, ok := l.Get("a"); !ok || got != 0 {
+		t.Errorf("Get(a) = %d, %t, want 0", got, ok)
+	}
+	// b is the least recently used now
+	l.Set("d", 1)
+	if _, ok := l.Get("b"); ok {
+		t.Errorf("b is kept, want evicted")
+	}
+	// Updating moves to the front too
+	l.Set("c", 0)
+	l.Set("e", 2)
+	if want := []string{"b", "a"}; !slices.Equal(evicted, want) {
+		t.Errorf("evicted = %v, want %v", evicted, want)
+	}
+	if want := map[string]int{"c": 0, "d": 1, "e": 2}; !maps.Equal(l.Map(), want) {
+		t.Errorf("Map() = %v, want %v", l.Map(), want)
+	}
+
+	// Has doesn't mark used
+	if !l.Has("d") {
+		t.Errorf("Has(d) = false")
+	}
+	l.Set("f", 0)
+	if l.Has("d") {
+		t.Errorf("d is kept, want evicted")
+	}
+
+	l.Delete("e")
+	if _, ok := l.Get("e"); ok || l.Len() != 2 {
+		t.Errorf("e is kept after Delete, Len() = %d", l.Len())
+	}
+	if want := []string{"b", "a", "d"}; !slices.Equal(evicted, want) {
+		t.Errorf("evicted = %v after Delete, want %v", evicted, want)
+	}
+}
+
+func TestLayoutLRURemap(t *testing.T) {
+	l := newLayoutLRU(0)
+	if l.size != defaultMaxWindows {
+		t.Errorf("size = %d, want %d", l.size, defaultMaxWindows)
+	}
+	l.Set("a", 0)
+	l.Set("b", 1)
+	l.Set("c", 2)
+	l.Remap(func(layout int) (int, bool) {
+		return layout - 1, layout > 0
+	})
+	if want := map[string]int{"b": 0, "c": 1}; !maps.Equal(l.Map(), want) {
+		t.Errorf("Map() = %v, want %v", l.Map(), want)
+	}
+	if l.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", l.Len())
+	}
+}
@@ -0,0 +1,59 @@
+package perwindowlayout
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are counters exposed in Prometheus text format.
+type metrics struct {
+	switches     atomic.Int64
+	switchErrors atomic.Int64
+	reconnects   atomic.Int64
+	// lastEvent is when the last event was processed, unix nanoseconds
+	lastEvent atomic.Int64
+
+	mu     sync.Mutex
+	events map[string]int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{events: make(map[string]int64)}
+}
+
+func (m *metrics) eventProcessed(name string) {
+	m.lastEvent.Store(time.Now().UnixNano())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events[name]++
+}
+
+func (m *metrics) write(w io.Writer, trackedWindows, knownWindows int) {
+	fmt.Fprintln(w, "# HELP perwindowlayout_switches_total Layout switches performed.")
+	fmt.Fprintln(w, "# TYPE perwindowlayout_switches_total counter")
+	fmt.Fprintf(w, "perwindowlayout_switches_total %d\n", m.switches.Load())
+	fmt.Fprintln(w, "# HELP perwindowlayout_switch_errors_total Layout switches failed.")
+	fmt.Fprintln(w, "# TYPE perwindowlayout_switch_errors_total counter")
+	fmt.Fprintf(w, "perwindowlayout_switch_errors_total %d\n", m.switchErrors.Load())
+	fmt.Fprintln(w, "# HELP perwindowlayout_reconnects_total Reconnects to Hyprland.")
+	fmt.Fprintln(w, "# TYPE perwindowlayout_reconnects_total counter")
+	fmt.Fprintf(w, "perwindowlayout_reconnects_total %d\n", m.reconnects.Load())
+	fmt.Fprintln(w, "# HELP perwindowlayout_events_total Hyprland events processed by type.")
+	fmt.Fprintln(w, "# TYPE perwindowlayout_events_total counter")
+	m.mu.Lock()
+	for _, name := range slices.Sorted(maps.Keys(m.events)) {
+		fmt.Fprintf(w, "perwindowlayout_events_total{event=%q} %d\n", name, m.events[name])
+	}
+	m.mu.Unlock()
+	fmt.Fprintln(w, "# HELP perwindowlayout_tracked_windows Windows with remembered layout.")
+	fmt.Fprintln(w, "# TYPE perwindowlayout_tracked_windows gauge")
+	fmt.Fprintf(w, "perwindowlayout_tracked_windows %d\n", trackedWindows)
+	fmt.Fprintln(w, "# HELP perwindowlayout_known_windows Windows class and title are kept for.")
+	fmt.Fprintln(w, "# TYPE perwindowlayout_known_windows gauge")
+	fmt.Fprintf(w, "perwindowlayout_known_windows %d\n", knownWindows)
+}
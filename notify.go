@@ -0,0 +1,24 @@
+package perwindowlayout
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"time"
+)
+
+const notifyTimeout = 5 * time.Second
+
+// notifyLayout shows desktop notification with the layout name. It doesn't
+// wait for notify-send, so a hanging notification daemon can't block the
+// event loop.
+func notifyLayout(name string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "notify-send", "--app-name=per-window-layout", "--expire-time=1500", "Keyboard layout", name)
+		if err := cmd.Run(); err != nil {
+			slog.Warn("Failed to send notification", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,418 @@
+// Package perwindowlayout keeps keyboard layout per Hyprland window: it
+// remembers the layout chosen in each window and switches back to it when the
+// window is focused again.
+package perwindowlayout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"perwindowlayout/config"
+	"perwindowlayout/hypr"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotConnected is returned by requests which need Hyprland connection
+// while there is none.
+var ErrNotConnected = fmt.Errorf("not connected to hyprland")
+
+// ErrSingleLayout is returned by Run when there is only one layout and
+// Options.ExitIfSingle is set.
+var ErrSingleLayout = fmt.Errorf("only one layout is configured")
+
+// ErrIdle is returned by Run when no events came for idle_timeout. The event
+// socket may die silently, like after resume, so it's worth connecting again
+// right away.
+var ErrIdle = fmt.Errorf("no hyprland events")
+
+// Client is what the event loop needs from Hyprland, implemented by
+// *hypr.Client.
+type Client interface {
+	ReadEvent(ctx context.Context) (hypr.Event, error)
+	ReadLayouts(ctx context.Context) (*hypr.Layouts, error)
+	ActiveWindow() (*hypr.Window, error)
+	Clients() ([]hypr.Window, error)
+	ActiveKeymap(device string) (string, error)
+	SwitchXKBLayout(device string, layoutIdx int) error
+	CycleXKBLayout(device string, next bool) error
+}
+
+// Options are the daemon settings which are not part of the config file.
+type Options struct {
+	// StatePath is where learned layouts are saved, they are not saved when
+	// it's empty
+	StatePath string
+	// DryRun logs layout switches instead of performing them
+	DryRun bool
+	// Notify shows desktop notification on switch, in addition to config
+	// notify option
+	Notify bool
+	// StatusFile is kept with the current layout name, not written when
+	// empty
+	StatusFile string
+	// Trace logs every event read, including ignored ones
+	Trace bool
+	// ExitIfSingle makes Run return ErrSingleLayout when kb_layout has a
+	// single layout, instead of waiting for more to be added
+	ExitIfSingle bool
+	// OnReady is called once, when the first connection is set up
+	OnReady func(ctx context.Context)
+}
+
+// Daemon holds what survives reconnects: config, learned layouts and
+// counters. Each connection to Hyprland is processed by Run.
+type Daemon struct {
+	// cfg is swapped by SetConfig, cfgMu serializes the swap with resolving
+	// layout names on connect
+	cfg   atomic.Pointer[config.Config]
+	cfgMu sync.Mutex
+	st    *State
+	opts  Options
+
+	metrics *metrics
+	changes *broker
+
+	ready sync.Once
+	// initialLayout is the layout active before the first connection, -1
+	// when unknown
+	initialLayout int
+
+	// tracker of the current connection, nil while disconnected
+	tracker atomic.Pointer[tracker]
+	// paused stops switching on focus, layouts are still learned
+	paused atomic.Bool
+}
+
+// New creates daemon with the config and state loaded before, st may be nil
+// to start from scratch.
+func New(cfg *config.Config, st *State, opts Options) *Daemon {
+	if st == nil {
+		st = &State{Layouts: make(map[string]int)}
+	}
+	d := &Daemon{
+		st:      st,
+		opts:    opts,
+		metrics: newMetrics(),
+		changes: newBroker(),
+	}
+	d.cfg.Store(cfg)
+	return d
+}
+
+// Run processes events of a single connection with default options, until
+// the connection breaks or ctx is cancelled.
+func Run(ctx context.Context, client Client, cfg *config.Config) error {
+	return New(cfg, nil, Options{}).Run(ctx, client, nil)
+}
+
+// Config returns the config in use, it must not be modified.
+func (d *Daemon) Config() *config.Config {
+	return d.cfg.Load()
+}
+
+// SetConfig swaps the config, layout names in it are resolved to the layouts
+// of the current connection.
+func (d *Daemon) SetConfig(cfg *config.Config) {
+	d.cfgMu.Lock()
+	defer d.cfgMu.Unlock()
+	if t := d.tracker.Load(); t != nil {
+		d.resolveConfig(cfg, t.indices())
+	} else {
+		d.cfg.Store(cfg)
+	}
+}
+
+// resolveConfig swaps the config for its copy resolved to the layouts, the
+// config in use is never changed in place as the event loop reads it. cfgMu
+// must be held.
+func (d *Daemon) resolveConfig(cfg *config.Config, layoutToIndex map[string]int) {
+	cfg = cfg.Clone()
+	cfg.Resolve(layoutToIndex)
+	d.cfg.Store(cfg)
+}
+
+// Run processes events of the client until the connection breaks or ctx is
+// cancelled. progress is called after each event read, may be nil.
+func (d *Daemon) Run(ctx context.Context, client Client, progress func()) error {
+	st := d.st
+
+	detected, err := client.ReadLayouts(ctx)
+	if err != nil {
+		return fmt.Errorf("could not detect layouts: %w", err)
+	}
+	t := newTracker(d, client, detected)
+	if windows, err := client.Clients(); err != nil {
+		slog.Warn(fmt.Sprintf("Could not list windows: %s", err))
+	} else {
+		t.seedWindows(windows)
+	}
+	if win, err := client.ActiveWindow(); err != nil {
+		slog.Warn(fmt.Sprintf("Could not get active window: %s", err))
+	} else if win != nil {
+		t.seed(win, detected.Active)
+	}
+	slog.Debug(fmt.Sprintf("Layouts: %v", t.layouts), "keyboard", t.keyboard)
+	slog.Info(fmt.Sprintf("Available keyboards: %s", strings.Join(detected.Keyboards, ", ")))
+	slog.Debug(fmt.Sprintf("Index Mapping: %+v", t.layoutToIndex))
+	if t.single() {
+		if d.opts.ExitIfSingle {
+			return ErrSingleLayout
+		}
+		slog.Info("Only one layout is configured, nothing to switch until more are added")
+	}
+	d.cfgMu.Lock()
+	d.resolveConfig(d.cfg.Load(), t.indices())
+	d.tracker.Store(t)
+	d.cfgMu.Unlock()
+	defer t.stop()
+	d.ready.Do(func() {
+		d.initialLayout = detected.Active
+		if d.opts.OnReady != nil {
+			d.opts.OnReady(ctx)
+		}
+	})
+	defer d.tracker.Store(nil)
+	defer d.saveState()
+
+	readCtx, cancelRead := context.WithCancelCause(ctx)
+	defer cancelRead(nil)
+	if idle := d.cfg.Load().IdleTimeout; idle > 0 {
+		go d.watchIdle(readCtx, idle, cancelRead)
+	}
+
+	for {
+		if st.saveDue() {
+			d.saveState()
+		}
+		evt, err := client.ReadEvent(readCtx)
+		if ctx.Err() != nil {
+			if d.cfg.Load().RestoreOnExit && d.initialLayout >= 0 {
+				t.restore(d.initialLayout)
+			}
+			return ctx.Err()
+		}
+		if readCtx.Err() != nil {
+			return context.Cause(readCtx)
+		}
+		if errors.Is(err, hypr.ErrMalformedEvent) {
+			slog.Warn(fmt.Sprintf("Skipping event: %s", err))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read hyprland event: %w", err)
+		}
+		if progress != nil {
+			progress()
+		}
+		if d.opts.Trace {
+			slog.Debug("Event", "name", evt.Name, "args", evt.Args)
+		}
+		d.metrics.eventProcessed(evt.Name)
+		if evt.Name != "activelayout" && t.single() {
+			// Only activelayout is of interest, it tells layouts were
+			// added
+			continue
+		}
+		t.handle(evt)
+		if err := t.executePlanned(); err != nil {
+			return err
+		}
+		if t.needsPrune() {
+			t.pruneWindows()
+		}
+		if t.needsRedetect() {
+			if err := d.redetect(ctx, t); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watchIdle cancels the connection with ErrIdle once there were no events for
+// idle. Hyprland may keep answering commands while the event socket is dead,
+// so only connecting again tells whether events still come.
+func (d *Daemon) watchIdle(ctx context.Context, idle time.Duration, cancel context.CancelCauseFunc) {
+	started := time.Now()
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last := d.LastEvent()
+		if last.Before(started) {
+			last = started
+		}
+		if time.Since(last) >= idle {
+			cancel(fmt.Errorf("%w for %s", ErrIdle, time.Since(last).Round(time.Second)))
+			return
+		}
+	}
+}
+
+func (d *Daemon) saveState() {
+	if d.opts.StatePath == "" {
+		return
+	}
+	if err := SaveState(d.opts.StatePath, d.st); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// Status returns what the daemon knows about the current connection.
+func (d *Daemon) Status() (Status, error) {
+	t := d.tracker.Load()
+	if t == nil {
+		return Status{}, ErrNotConnected
+	}
+	return t.status(), nil
+}
+
+// SetLayout switches the focused window to the layout given by index or name
+// and remembers it as chosen by hand.
+func (d *Daemon) SetLayout(layout string) error {
+	t := d.tracker.Load()
+	if t == nil {
+		return ErrNotConnected
+	}
+	return t.setLayout(layout)
+}
+
+// Redetect makes layouts of the current connection detected again, for the
+// case kb_layout was changed while the daemon runs. Detection switches
+// layouts, so it's done by the event loop after the next event. Layouts
+// learned for windows are kept by layout name.
+func (d *Daemon) Redetect() error {
+	t := d.tracker.Load()
+	if t == nil {
+		return ErrNotConnected
+	}
+	t.requestRedetect()
+	return nil
+}
+
+// redetect detects layouts of t again and resolves the config to them. Only
+// the event loop calls it.
+func (d *Daemon) redetect(ctx context.Context, t *tracker) error {
+	layoutToIndex, err := t.redetect(ctx)
+	if err != nil {
+		return err
+	}
+	d.cfgMu.Lock()
+	defer d.cfgMu.Unlock()
+	d.resolveConfig(d.cfg.Load(), layoutToIndex)
+	return nil
+}
+
+// SetPaused stops or resumes switching layouts on focus. Layouts chosen in
+// windows are learned while paused too.
+func (d *Daemon) SetPaused(paused bool) {
+	if d.paused.Swap(paused) != paused {
+		logPaused(paused)
+	}
+}
+
+// TogglePaused pauses switching when it's resumed and the other way around,
+// it returns whether switching is paused now.
+func (d *Daemon) TogglePaused() bool {
+	for {
+		paused := d.paused.Load()
+		if d.paused.CompareAndSwap(paused, !paused) {
+			logPaused(!paused)
+			return !paused
+		}
+	}
+}
+
+func logPaused(paused bool) {
+	if paused {
+		slog.Info("Paused switching layouts")
+	} else {
+		slog.Info("Resumed switching layouts")
+	}
+}
+
+// Paused reports whether switching layouts is paused.
+func (d *Daemon) Paused() bool {
+	return d.paused.Load()
+}
+
+// Connected reports whether the daemon is processing events of a connection.
+func (d *Daemon) Connected() bool {
+	return d.tracker.Load() != nil
+}
+
+// LastEvent returns when the last event was processed, zero time if none
+// was.
+func (d *Daemon) LastEvent() time.Time {
+	nanos := d.metrics.lastEvent.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Subscribe returns channel of JSON encoded LayoutChange, one per layout
+// change. It's closed when the subscriber is too slow, or unsubscribe is
+// called.
+func (d *Daemon) Subscribe() (changes <-chan []byte, unsubscribe func()) {
+	return d.changes.subscribe()
+}
+
+// Reconnected counts reconnect to Hyprland in metrics.
+func (d *Daemon) Reconnected() {
+	d.metrics.reconnects.Add(1)
+}
+
+// WriteMetrics writes counters in Prometheus text format.
+func (d *Daemon) WriteMetrics(w io.Writer) {
+	tracked, known := 0, 0
+	if t := d.tracker.Load(); t != nil {
+		tracked, known = t.trackedWindows()
+	}
+	d.metrics.write(w, tracked, known)
+}
+
+// WindowLayout is the layout the daemon would switch the active window to.
+type WindowLayout struct {
+	// Window is nil when no window is focused
+	Window *hypr.Window
+	Layout int
+	// Active is the active layout, -1 when unknown
+	Active  int
+	Layouts []string
+}
+
+// ActiveWindowLayout detects layouts and resolves the layout for the active
+// window the same way Run does, without switching.
+func (d *Daemon) ActiveWindowLayout(ctx context.Context, client Client) (*WindowLayout, error) {
+	detected, err := client.ReadLayouts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not detect layouts: %w", err)
+	}
+	t := newTracker(d, client, detected)
+	d.cfgMu.Lock()
+	d.resolveConfig(d.cfg.Load(), t.indices())
+	d.cfgMu.Unlock()
+	res := &WindowLayout{Active: detected.Active, Layouts: t.layouts}
+	res.Window, err = client.ActiveWindow()
+	if err != nil {
+		return nil, fmt.Errorf("could not get active window: %w", err)
+	}
+	if res.Window == nil {
+		return res, nil
+	}
+	// Not passing the active layout, so it isn't taken as learned one
+	t.seed(res.Window, -1)
+	t.mu.Lock()
+	res.Layout = t.windowLayout()
+	t.mu.Unlock()
+	return res, nil
+}
@@ -0,0 +1,308 @@
+package perwindowlayout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"perwindowlayout/config"
+	"perwindowlayout/hypr"
+	"perwindowlayout/hypr/hyprtest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testLayouts = hypr.Layouts{
+	Keyboard: "kb",
+	Names:    []string{"English (US)", "Russian", "German"},
+	Shorts:   []string{"us", "ru", "de"},
+	Active:   0,
+}
+
+// loadConfig loads config from the TOML text.
+func loadConfig(t *testing.T, text string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// focusLoop keeps switching focus between two windows until ctx is
+// cancelled, so the event loop runs concurrently with the test.
+type focusLoop struct {
+	*hyprtest.Client
+	events atomic.Int64
+}
+
+func newFocusLoop() *focusLoop {
+	c := &focusLoop{Client: hyprtest.NewClient(testLayouts)}
+	c.Windows = []hypr.Window{
+		{Address: "0xa1", Class: "firefox", Title: "Mozilla Firefox"},
+		{Address: "0xb2", Class: "kitty", Title: "zsh"},
+	}
+	return c
+}
+
+func (c *focusLoop) ReadEvent(ctx context.Context) (hypr.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return hypr.Event{}, err
+	}
+	if c.events.Add(1)%2 == 0 {
+		return hyprtest.Event("activewindowv2", "a1"), nil
+	}
+	return hyprtest.Event("activewindowv2", "b2"), nil
+}
+
+func TestSetLayoutWhileRunning(t *testing.T) {
+	client := newFocusLoop()
+	d := New(loadConfig(t, ""), nil, Options{StatePath: filepath.Join(t.TempDir(), "state.json")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.Run(ctx, client, nil)
+	}()
+	for !d.Connected() {
+		time.Sleep(time.Millisecond)
+	}
+	var wg sync.WaitGroup
+	for _, layout := range []string{"0", "Russian", "2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				// Fails only when nothing is focused yet
+				d.SetLayout(layout)
+				d.Status()
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Run() = %v, want %v", err, context.Canceled)
+	}
+	st, err := LoadState(d.opts.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Layouts) == 0 {
+		t.Errorf("no layouts saved")
+	}
+}
+
+func TestReloadWhileRunning(t *testing.T) {
+	client := newFocusLoop()
+	cfg := loadConfig(t, `
+default_layout = "Russian"
+
+[workspaces]
+"1" = "German"
+
+[[rules]]
+class = "kitty"
+layout = "English (US)"
+`)
+	d := New(cfg, nil, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.Run(ctx, client, nil)
+	}()
+	for !d.Connected() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 200; i++ {
+		d.SetConfig(cfg)
+		if i%10 == 0 {
+			if err := d.Redetect(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Run() = %v, want %v", err, context.Canceled)
+	}
+	if got := d.Config().Rules[0].Layout.Index; got != 0 {
+		t.Errorf("rule layout = %d, want 0", got)
+	}
+	if got := d.Config().DefaultLayout.Index; got != 1 {
+		t.Errorf("default layout = %d, want 1", got)
+	}
+}
+
+// malformedFirst returns a malformed event error before the scripted events.
+type malformedFirst struct {
+	*hyprtest.Client
+	returned bool
+}
+
+func (c *malformedFirst) ReadEvent(ctx context.Context) (hypr.Event, error) {
+	if !c.returned {
+		c.returned = true
+		return hypr.Event{}, fmt.Errorf("%w: %q", hypr.ErrMalformedEvent, "garbage")
+	}
+	return c.Client.ReadEvent(ctx)
+}
+
+func TestRunSkipsMalformed(t *testing.T) {
+	client := &malformedFirst{Client: hyprtest.NewClient(testLayouts, hyprtest.Event("activewindowv2", "a1"))}
+	err := New(loadConfig(t, "default_layout = 1"), nil, Options{}).Run(context.Background(), client, nil)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Run() = %v, want %v", err, io.EOF)
+	}
+	want := []hyprtest.Switch{{Device: "kb", Layout: 1}}
+	if got := client.Switches(); !slices.Equal(got, want) {
+		t.Errorf("switches = %v, want %v", got, want)
+	}
+}
+
+func TestEchoedSwitch(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []hyprtest.Switch
+	}{
+		{
+			name:   "already active",
+			config: "default_layout = 0",
+		},
+		{
+			name:   "switched once",
+			config: "default_layout = 2",
+			want:   []hyprtest.Switch{{Device: "kb", Layout: 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := hyprtest.NewClient(testLayouts,
+				hyprtest.Event("activewindow", "kitty,zsh"),
+				hyprtest.Event("activewindowv2", "a1"),
+				hyprtest.Event("activewindow", "kitty,vim"),
+				hyprtest.Event("activewindowv2", "b2"),
+			)
+			// The activelayout of each switch comes back right away
+			client.Echo = true
+			err := New(loadConfig(t, tt.config), nil, Options{}).Run(context.Background(), client, nil)
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("Run() = %v, want %v", err, io.EOF)
+			}
+			if got := client.Switches(); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunOverSockets(t *testing.T) {
+	srv, err := hyprtest.NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Devices = `{"keyboards": [{"name": "kb", "layout": "us,ru", "variant": "", "active_keymap": "English (US)", "main": true}]}`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, closeClient, err := hypr.NewClient(ctx, hypr.WithSocketDir(srv.Dir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeClient()
+	d := New(loadConfig(t, "[[rules]]\nclass = \"kitty\"\nlayout = \"Russian\""), nil, Options{})
+	done := make(chan error)
+	go func() {
+		done <- d.Run(ctx, client, nil)
+	}()
+
+	srv.WaitClient()
+	// Like Hyprland, each switch is followed by activelayout
+	err = srv.Send(
+		"activewindow>>firefox,Mozilla Firefox",
+		"activewindowv2>>a1",
+		"activelayout>>kb,English (US)",
+		"activewindow>>kitty,zsh",
+		"activewindowv2>>b2",
+		"activelayout>>kb,Russian",
+		"activewindow>>firefox,Mozilla Firefox",
+		"activewindowv2>>a1",
+		"activelayout>>kb,English (US)",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"switchxkblayout kb 1", "switchxkblayout kb 0"}
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got = got[:0]
+		for _, cmd := range srv.Commands() {
+			if strings.HasPrefix(cmd, "switchxkblayout ") {
+				got = append(got, cmd)
+			}
+		}
+		if len(got) >= len(want) {
+			break
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("switch commands = %q, want %q", got, want)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestIdleReconnect(t *testing.T) {
+	srv, err := hyprtest.NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Devices = `{"keyboards": [{"name": "kb", "layout": "us,ru", "variant": "", "active_keymap": "English (US)", "main": true}]}`
+	srv.Replies = map[string]string{"j/clients": "[]"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, closeClient, err := hypr.NewClient(ctx, hypr.WithSocketDir(srv.Dir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeClient()
+	done := make(chan error)
+	go func() {
+		done <- New(loadConfig(t, "idle_timeout = \"50ms\""), nil, Options{}).Run(ctx, client, nil)
+	}()
+
+	srv.WaitClient()
+	// The event socket goes silent after that, while commands are still
+	// answered
+	if err := srv.Send("activewindowv2>>a1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrIdle) {
+			t.Errorf("Run() = %v, want %v", err, ErrIdle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() keeps waiting for events")
+	}
+	if _, err := client.ActiveWindow(); err != nil {
+		t.Errorf("ActiveWindow() error = %v, want command socket answering", err)
+	}
+}
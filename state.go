@@ -0,0 +1,131 @@
+package perwindowlayout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"perwindowlayout/xdg"
+	"sync"
+	"time"
+)
+
+// stateSaveInterval limits how often learned layouts are flushed to disk.
+const stateSaveInterval = 30 * time.Second
+
+// State is learned layouts persisted between daemon restarts. Window addresses
+// are not stable between sessions, so layouts are keyed by window identity
+// built from class and title (see stateKey). It's safe for concurrent use,
+// as layouts are set from the control socket too.
+type State struct {
+	Layouts map[string]int `json:"layouts"`
+
+	mu      sync.Mutex
+	dirty   bool
+	savedAt time.Time
+}
+
+func DefaultStatePath() string {
+	return xdg.StateFile("state.json")
+}
+
+func LoadState(path string) (*State, error) {
+	st := &State{Layouts: make(map[string]int)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("failed to parse state %s: %w", path, err)
+	}
+	if st.Layouts == nil {
+		st.Layouts = make(map[string]int)
+	}
+	return st, nil
+}
+
+func SaveState(path string, st *State) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace state %s: %w", path, err)
+	}
+	st.dirty = false
+	st.savedAt = time.Now()
+	return nil
+}
+
+// Get returns the learned layout of the window key.
+func (st *State) Get(key string) (int, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	layout, ok := st.Layouts[key]
+	return layout, ok
+}
+
+func (st *State) Set(key string, layout int) {
+	if key == "" {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if old, ok := st.Layouts[key]; ok && old == layout {
+		return
+	}
+	st.Layouts[key] = layout
+	st.dirty = true
+}
+
+// Remap replaces each learned layout with the one f returns, layouts f
+// returns false for are forgotten.
+func (st *State) Remap(f func(layout int) (int, bool)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for key, old := range st.Layouts {
+		layout, ok := f(old)
+		if !ok {
+			delete(st.Layouts, key)
+		} else if layout != old {
+			st.Layouts[key] = layout
+		} else {
+			continue
+		}
+		st.dirty = true
+	}
+}
+
+// saveDue tells there are changes not saved for longer than
+// stateSaveInterval.
+func (st *State) saveDue() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.dirty && time.Since(st.savedAt) > stateSaveInterval
+}
+
+// stateKey builds persistent window identity according to config state_key
+// option: "class" or "class+title" (the default).
+func stateKey(mode, class, title string) string {
+	if class == "" {
+		return ""
+	}
+	if mode == "class" {
+		return class
+	}
+	return class + "\x00" + title
+}
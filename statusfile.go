@@ -0,0 +1,31 @@
+package perwindowlayout
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func DefaultStatusFilePath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "per-window-layout", "current")
+}
+
+// writeStatusFile replaces content of the file at path with the layout name,
+// atomically, so status bars never read a half-written file.
+func writeStatusFile(path, layout string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create status file dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(layout+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write status file %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace status file %s: %w", path, err)
+	}
+	return nil
+}
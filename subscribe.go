@@ -0,0 +1,74 @@
+package perwindowlayout
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+)
+
+// LayoutChange is sent to subscribers of the control socket each time the
+// layout changes.
+type LayoutChange struct {
+	Window     string `json:"window"`
+	Layout     int    `json:"layout"`
+	LayoutName string `json:"layout_name"`
+}
+
+// subscriberBuffer is how many changes may wait for a subscriber before it's
+// considered too slow and dropped.
+const subscriberBuffer = 16
+
+// broker fans layout changes out to subscribers. Publishing never blocks,
+// subscribers that don't keep up are dropped instead.
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan []byte]struct{})}
+}
+
+// subscribe returns channel of JSON encoded changes, it's closed when the
+// subscriber is dropped or unsubscribe is called.
+func (b *broker) subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.drop(ch)
+	}
+}
+
+// drop removes the subscriber, b.mu must be held.
+func (b *broker) drop(ch chan []byte) {
+	if _, ok := b.subs[ch]; !ok {
+		return
+	}
+	delete(b.subs, ch)
+	close(ch)
+}
+
+func (b *broker) publish(change LayoutChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- line:
+		default:
+			slog.Warn("Dropping slow layout change subscriber")
+			b.drop(ch)
+		}
+	}
+}
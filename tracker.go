@@ -0,0 +1,935 @@
+package perwindowlayout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"perwindowlayout/config"
+	"perwindowlayout/hypr"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// windowAddress normalizes window address so the ones coming from different
+// events can be compared. Empty and null (0x0) addresses, which stand for no
+// window, are returned as empty.
+func windowAddress(addr string) string {
+	addr = strings.TrimPrefix(strings.TrimSpace(addr), "0x")
+	if strings.Trim(addr, "0") == "" {
+		return ""
+	}
+	return addr
+}
+
+// tracker follows focus and layout changes of a single Hyprland connection.
+// It's guarded by mutex, because the control socket reads it concurrently
+// with the event loop.
+type tracker struct {
+	mu sync.Mutex
+
+	daemon   *Daemon
+	client   Client
+	keyboard string
+	// managed are keyboards switched on focus change
+	managed []string
+	// mirrored follow layout changes of keyboard
+	mirrored      []string
+	layouts       []string
+	layoutToIndex map[string]int
+
+	// layoutMap is keyed by layoutKey
+	layoutMap  *layoutLRU
+	windowKeys map[string]string
+	// windows are class and title of each known window, kept up to date
+	// by events. classWindows counts open windows of each class.
+	windows          map[string]windowMeta
+	classWindows     map[string]int
+	currentWindowId  string
+	currentClass     string
+	currentTitle     string
+	currentWorkspace string
+	currentLayout    int
+	// currentMonitor is known after the first focusedmon only
+	currentMonitor string
+	// currentSpecial is the shown special workspace (scratchpad), if any
+	currentSpecial string
+	// manual are layouts user chose by hand, they stick until the window is
+	// closed
+	manual map[string]int
+	// selfSwitches are switches we made, which activelayout is yet to come
+	// for
+	selfSwitches []selfSwitch
+	// currentIgnored is set when the focused window class is in ignore list
+	currentIgnored bool
+
+	// seenV2 is set once Hyprland emits activewindowv2, until then windows
+	// are tracked by activewindow
+	seenV2 bool
+	// queried is the active layout reported by Hyprland at queriedAt, see
+	// queryLayout
+	queried   int
+	queriedAt time.Time
+	// pending is the debounced switch waiting for focus to settle
+	pending *time.Timer
+	// planned are switches decided on by handle, yet to be executed
+	planned []*switchPlan
+	// stale is set when activelayout named a layout which is not detected,
+	// so layouts are to be detected again
+	stale bool
+	// unknownLayouts are names activelayout reported which layouts were
+	// detected again for
+	unknownLayouts map[string]bool
+	// detecting are names of layouts detection switched to, which
+	// activelayout is yet to come for until detectingUntil. The user chose
+	// none of them.
+	detecting      []string
+	detectingUntil time.Time
+	// pruneAt is how many known windows make them checked against the open
+	// ones, pruneDue is set once there are that many
+	pruneAt  int
+	pruneDue bool
+	// now is the clock self switches expire by
+	now func() time.Time
+}
+
+func newTracker(d *Daemon, client Client, detected *hypr.Layouts) *tracker {
+	t := &tracker{
+		daemon:         d,
+		client:         client,
+		keyboard:       detected.Keyboard,
+		layouts:        detected.Names,
+		layoutToIndex:  make(map[string]int),
+		layoutMap:      newLayoutLRU(d.cfg.Load().MaxWindows),
+		windowKeys:     make(map[string]string),
+		windows:        make(map[string]windowMeta),
+		classWindows:   make(map[string]int),
+		manual:         make(map[string]int),
+		unknownLayouts: make(map[string]bool),
+		currentLayout:  detected.Active,
+		now:            time.Now,
+	}
+	t.expectDetection(detected)
+	t.managed = []string{t.keyboard}
+	if kb := d.cfg.Load().ManagedKeyboard; kb != "" {
+		// Events of other keyboards are dropped, as they don't match
+		// t.keyboard
+		if kb != t.keyboard {
+			slog.Warn(fmt.Sprintf("Managed keyboard %s not found, not switching layouts", kb))
+			t.keyboard, t.managed = kb, nil
+		}
+	} else if managed := d.cfg.Load().Keyboards; len(managed) > 0 {
+		t.managed = nil
+		for _, kb := range managed {
+			if !slices.Contains(detected.Keyboards, kb) {
+				slog.Warn(fmt.Sprintf("Configured keyboard %s not found, not managing it", kb))
+				continue
+			}
+			t.managed = append(t.managed, kb)
+		}
+	}
+	for _, kb := range d.cfg.Load().Mirror {
+		if !slices.Contains(detected.Keyboards, kb) {
+			slog.Warn(fmt.Sprintf("Mirrored keyboard %s not found, not mirroring to it", kb))
+			continue
+		}
+		t.mirrored = append(t.mirrored, kb)
+	}
+	for i, l := range t.layouts {
+		t.layoutToIndex[l] = i
+	}
+	t.pruneAt = 2 * t.layoutMap.size
+	// Called under t.mu, as layoutMap is only set with it held
+	t.layoutMap.onEvict = func(key string) {
+		delete(t.manual, key)
+	}
+	return t
+}
+
+// seed starts tracking from the window focused before the daemon connected
+// and its current layout, so its layout changes are not missed.
+func (t *tracker) seed(win *hypr.Window, layout int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.currentWindowId = windowAddress(win.Address)
+	t.currentClass, t.currentTitle = win.Class, win.Title
+	t.currentWorkspace = win.Workspace.Name
+	t.currentIgnored = t.daemon.cfg.Load().Ignored(win.Class)
+	t.windowKeys[t.currentWindowId] = stateKey(t.daemon.cfg.Load().StateKey, win.Class, win.Title)
+	t.addWindow(t.currentWindowId, win.Class, win.Title)
+	t.currentLayout = layout
+	if layout >= 0 && !t.currentIgnored {
+		t.layoutMap.Set(t.layoutKey(t.currentWindowId), layout)
+	}
+	slog.Debug("Seeded active window", "window", t.currentWindowId, "layout", layout, "name", t.layoutName(layout))
+}
+
+// handle updates the state by the event. Switches it decides on are planned,
+// to be made by executePlanned.
+func (t *tracker) handle(evt hypr.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.daemon.st
+	switch evt.Name {
+	case "activewindow":
+		{
+			fields := evt.Fields()
+			t.currentClass, t.currentTitle = fields[0], fields[1]
+			if !t.seenV2 {
+				if t.currentClass == "" && t.currentTitle == "" {
+					// Focus moved to the empty workspace
+					t.currentWindowId = ""
+					return
+				}
+				// activewindowv2 is not emitted (yet), so identify window
+				// by class and title instead of address. That's less
+				// precise: windows of the same app with the same title
+				// share the layout, and title change makes window a new
+				// one.
+				t.focus("v1:" + t.currentClass + "," + t.currentTitle)
+			}
+		}
+	case "workspace":
+		{
+			t.currentWorkspace = evt.Fields()[0]
+		}
+	case "workspacev2":
+		{
+			t.currentWorkspace = evt.Fields()[1]
+		}
+	case "focusedmon":
+		{
+			fields := evt.Fields()
+			t.currentMonitor, t.currentWorkspace = fields[0], fields[1]
+		}
+	case "activespecial":
+		{
+			// Empty name means the special workspace was hidden, its
+			// windows stay open though
+			t.currentSpecial = evt.Fields()[0]
+		}
+	case "windowtitlev2":
+		{
+			fields := evt.Fields()
+			windowId := windowAddress(fields[0])
+			if w, ok := t.windows[windowId]; ok {
+				w.title = fields[1]
+				t.windows[windowId] = w
+			}
+			if windowId == t.currentWindowId {
+				t.currentTitle = fields[1]
+			}
+		}
+	case "activelayout":
+		{
+			fields := evt.Fields()
+			keyboard, layout := fields[0], fields[1]
+			if keyboard != t.keyboard {
+				// Other keyboards have their own layouts, which say
+				// nothing about the layout of the window
+				return
+			}
+			t.writeStatus(layout)
+			idx, known := t.layoutToIndex[layout]
+			if t.takeDetection(layout) {
+				// Detection cycles through layouts and back, nothing is
+				// learned, mirrored or published for it
+				t.currentLayout = -1
+				if known {
+					t.currentLayout = idx
+				}
+				t.queriedAt = time.Time{}
+				return
+			}
+			if !known {
+				// Whatever it is, it's not the layout recorded before
+				t.currentLayout = -1
+				if t.unknownLayouts[layout] {
+					slog.Warn(fmt.Sprintf("Ignoring unknown layout %s, it's not detected", layout))
+					return
+				}
+				// kb_layout was changed since layouts were detected, or
+				// the name is reported differently. Detecting again once
+				// per name, as it may take switching.
+				slog.Info(fmt.Sprintf("Unknown layout %s, detecting layouts again", layout))
+				t.unknownLayouts[layout] = true
+				t.stale = true
+				return
+			}
+			t.currentLayout = idx
+			t.queriedAt = time.Time{}
+			t.mirror(idx)
+			t.daemon.changes.publish(LayoutChange{
+				Window:     t.currentWindowId,
+				Layout:     t.currentLayout,
+				LayoutName: layout,
+			})
+			self, isSelf := t.takeSelfSwitch(t.currentLayout)
+			if t.currentWindowId == "" {
+				return
+			}
+			if t.currentIgnored {
+				return
+			}
+			if isSelf && self.window != t.currentWindowId {
+				// Our switch for the previous window landed after focus
+				// moved on, so it's not the layout of the current one
+				want := t.windowLayout()
+				pending := slices.ContainsFunc(t.selfSwitches, func(s selfSwitch) bool {
+					return s.window == t.currentWindowId && s.layout == want
+				})
+				if want != t.currentLayout && !pending {
+					t.decide(want)
+				}
+				return
+			}
+			if _, pinned := t.daemon.cfg.Load().PinnedLayout(t.currentClass, t.currentTitle); pinned {
+				// Switched back on the next focus, whatever is chosen
+				return
+			}
+			if !isSelf {
+				// While paused the layout isn't switched back, so it's
+				// learned like any other
+				if allowed, ok := t.snapBack(); ok && !t.daemon.Paused() {
+					// The switch back is expected, so it's not snapped
+					// again
+					slog.Debug(fmt.Sprintf("Layout %s is not allowed, switching to %s", layout, t.layoutName(allowed)), "window", t.currentWindowId)
+					t.decide(allowed)
+					return
+				}
+				t.manual[t.layoutKey(t.currentWindowId)] = t.currentLayout
+			}
+			t.layoutMap.Set(t.layoutKey(t.currentWindowId), t.currentLayout)
+			st.Set(t.windowKeys[t.currentWindowId], t.currentLayout)
+		}
+	case "activewindowv2":
+		{
+			t.seenV2 = true
+			windowId := windowAddress(evt.Fields()[0])
+			if windowId == "" {
+				// Nothing is focused, e.g. the scratchpad was hidden or
+				// focus moved to the empty workspace.
+				// Layout of the window is kept until it's focused again.
+				t.currentWindowId = ""
+				return
+			}
+			if w, ok := t.windows[windowId]; ok {
+				// Known without activewindow, which may be missed when
+				// focus moves quickly
+				t.currentClass, t.currentTitle = w.class, w.title
+			}
+			t.focus(windowId)
+		}
+	case "openwindow":
+		{
+			cfg := t.daemon.cfg.Load()
+			fields := evt.Fields()
+			windowId, workspace, class, title := windowAddress(fields[0]), fields[1], fields[2], fields[3]
+			shared := cfg.TrackBy == "class" && t.classWindows[class] > 0
+			t.addWindow(windowId, class, title)
+			if !cfg.ForceDefaultOnOpen || cfg.Ignored(class) {
+				return
+			}
+			if shared {
+				// The window takes the layout of other open windows of
+				// the app
+				return
+			}
+			// Learned layouts of the previous windows with the same
+			// identity are not inherited
+			layout := cfg.LayoutFor(class, title, workspace, t.currentMonitor)
+			t.layoutMap.Set(t.layoutKey(windowId), layout)
+			if windowId == t.currentWindowId && layout != t.currentLayout {
+				t.decide(layout)
+			}
+		}
+	case "fullscreen", "openlayer", "closelayer":
+		{
+			// Focus stays on the same window, which is what layout
+			// depends on. When focus moves with them, activewindowv2
+			// follows: with unchanged address for fullscreen, empty one
+			// for layers like launchers.
+		}
+	case "closewindow":
+		{
+			// Only closing forgets the window. Moving to a special
+			// workspace is how windows are hidden (minimized), they keep
+			// their address and learned layout until shown again.
+			t.closeWindow(windowAddress(evt.Fields()[0]))
+		}
+	}
+}
+
+// focus handles focus change to the window, switching to its layout.
+func (t *tracker) focus(newWindowId string) {
+	cfg := t.daemon.cfg.Load()
+	if t.currentWindowId == newWindowId {
+		return
+	}
+	t.currentWindowId = newWindowId
+	t.currentIgnored = cfg.Ignored(t.currentClass)
+	if t.currentIgnored {
+		// The window manages input itself, leave the layout as is
+		if t.pending != nil {
+			t.pending.Stop()
+		}
+		return
+	}
+	if _, seen := t.windowKeys[t.currentWindowId]; !seen {
+		t.windowKeys[t.currentWindowId] = stateKey(cfg.StateKey, t.currentClass, t.currentTitle)
+	}
+	t.addWindow(t.currentWindowId, t.currentClass, t.currentTitle)
+	windowLayout := t.windowLayout()
+	if cfg.QueryLayout {
+		if actual, ok := t.queryLayout(); ok {
+			t.currentLayout = actual
+		}
+	}
+	if windowLayout == t.currentLayout {
+		return
+	}
+	if cfg.Debounce > 0 {
+		t.scheduleSwitch(cfg.Debounce, t.currentWindowId, windowLayout)
+		return
+	}
+	t.decide(windowLayout)
+}
+
+// snapBack returns the allowed layout to switch the current window to, when
+// its current layout is not allowed. It's the next allowed one in the
+// direction of the switch from its previous layout. t.mu must be held.
+func (t *tracker) snapBack() (int, bool) {
+	allowed := t.daemon.cfg.Load().AllowedFor(t.currentClass)
+	if len(allowed) == 0 || slices.Contains(allowed, t.currentLayout) {
+		return 0, false
+	}
+	n, dir := len(t.layouts), 1
+	if prev, ok := t.layoutMap.Get(t.layoutKey(t.currentWindowId)); ok {
+		if forward := ((t.currentLayout-prev)%n + n) % n; forward > n/2 {
+			dir = -1
+		}
+	}
+	for i := 1; i < n; i++ {
+		if l := ((t.currentLayout+dir*i)%n + n) % n; slices.Contains(allowed, l) {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+// windowInfo is what layout of a window is resolved from.
+type windowInfo struct {
+	class, title, workspace, monitor string
+	// manual is the layout chosen by hand, learned is the one seen last in
+	// the window or persisted for it. They are -1 when there is none.
+	manual, learned int
+}
+
+// resolveLayout returns layout of the window, the first one known wins:
+//
+//  1. pinned by rule
+//  2. chosen by hand, until the window is closed
+//  3. learned in this session, or persisted from the previous ones
+//  4. configured, see config.Config.LayoutFor for its precedence
+func resolveLayout(cfg *config.Config, w windowInfo) int {
+	if layout, pinned := cfg.PinnedLayout(w.class, w.title); pinned {
+		return layout
+	}
+	if w.manual >= 0 {
+		return w.manual
+	}
+	if w.learned >= 0 {
+		return w.learned
+	}
+	return cfg.LayoutFor(w.class, w.title, w.workspace, w.monitor)
+}
+
+// windowLayout returns layout of the current window, t.mu must be held.
+func (t *tracker) windowLayout() int {
+	w := windowInfo{
+		class:     t.currentClass,
+		title:     t.currentTitle,
+		workspace: t.workspace(),
+		monitor:   t.currentMonitor,
+		manual:    -1,
+		learned:   -1,
+	}
+	key := t.layoutKey(t.currentWindowId)
+	if layout, ok := t.manual[key]; ok {
+		w.manual = layout
+	}
+	if layout, ok := t.layoutMap.Get(key); ok {
+		w.learned = layout
+	} else if layout, ok := t.daemon.st.Get(t.windowKeys[t.currentWindowId]); ok {
+		w.learned = layout
+	}
+	return t.validLayout(resolveLayout(t.daemon.cfg.Load(), w))
+}
+
+// validLayout replaces layout which doesn't exist with a valid one, such
+// indices come from the state saved before kb_layout was changed.
+func (t *tracker) validLayout(layout int) int {
+	if layout >= 0 && layout < len(t.layouts) {
+		return layout
+	}
+	cfg := t.daemon.cfg.Load()
+	valid := cfg.LayoutFor(t.currentClass, t.currentTitle, t.workspace(), t.currentMonitor)
+	if cfg.InvalidLayout == "clamp" {
+		valid = max(0, min(layout, len(t.layouts)-1))
+	}
+	if valid >= len(t.layouts) {
+		valid = 0
+	}
+	slog.Warn(fmt.Sprintf("Layout %d does not exist, there are %d layouts, using %d instead", layout, len(t.layouts), valid), "window", t.currentWindowId)
+	return valid
+}
+
+// setLayout switches the focused window to the layout given by index or name
+// and remembers it as chosen by hand.
+func (t *tracker) setLayout(layout string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	idx, err := strconv.Atoi(layout)
+	if err != nil {
+		var ok bool
+		if idx, ok = t.layoutToIndex[layout]; !ok {
+			return fmt.Errorf("unknown layout %q", layout)
+		}
+	}
+	if idx < 0 || idx >= len(t.layouts) {
+		return fmt.Errorf("layout index %d out of range, there are %d layouts", idx, len(t.layouts))
+	}
+	if t.currentWindowId == "" {
+		return errors.New("no window is focused")
+	}
+	key := t.layoutKey(t.currentWindowId)
+	t.manual[key] = idx
+	t.layoutMap.Set(key, idx)
+	t.daemon.st.Set(t.windowKeys[t.currentWindowId], idx)
+	if t.pending != nil {
+		t.pending.Stop()
+	}
+	return t.switchTo(idx)
+}
+
+// workspace returns name of the workspace focus is on, the special one when
+// it's shown.
+func (t *tracker) workspace() string {
+	if t.currentSpecial != "" {
+		return t.currentSpecial
+	}
+	return t.currentWorkspace
+}
+
+// windowMeta is what is known about an open window.
+type windowMeta struct {
+	class, title string
+}
+
+// seedWindows records windows open before the daemon connected, so their
+// class and title are known without asking Hyprland on focus.
+func (t *tracker) seedWindows(windows []hypr.Window) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, w := range windows {
+		t.addWindow(windowAddress(w.Address), w.Class, w.Title)
+	}
+	slog.Debug(fmt.Sprintf("Seeded %d open windows", len(windows)))
+}
+
+// addWindow records class and title of the window, unless it's known
+// already.
+func (t *tracker) addWindow(windowId, class, title string) {
+	if _, ok := t.windows[windowId]; ok {
+		return
+	}
+	if len(t.windows) >= t.pruneAt {
+		t.pruneDue = true
+	}
+	t.windows[windowId] = windowMeta{class: class, title: title}
+	t.classWindows[class]++
+}
+
+// needsPrune reports whether known windows are to be checked against the
+// open ones.
+func (t *tracker) needsPrune() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pruneDue
+}
+
+// pruneWindows forgets known windows which are not open anymore, their
+// closewindow was missed. Otherwise known windows would grow without bound.
+func (t *tracker) pruneWindows() {
+	windows, err := t.client.Clients()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneDue = false
+	defer func() {
+		// Checked again once there are twice as many, so many open windows
+		// don't make it happen on each new one
+		t.pruneAt = max(2*t.layoutMap.size, 2*len(t.windows))
+	}()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Could not list windows to forget closed ones: %s", err))
+		return
+	}
+	if len(windows) == 0 {
+		// Replays can't list windows, and there is no telling them from
+		// Hyprland without windows
+		return
+	}
+	open := make(map[string]bool, len(windows))
+	for _, w := range windows {
+		open[windowAddress(w.Address)] = true
+	}
+	pruned := 0
+	for windowId := range t.windows {
+		if !open[windowId] {
+			t.closeWindow(windowId)
+			pruned++
+		}
+	}
+	slog.Debug(fmt.Sprintf("Forgot %d closed windows", pruned), "known", len(t.windows))
+}
+
+// closeWindow forgets the window and its layout, unless it's shared with
+// other open windows of the class.
+func (t *tracker) closeWindow(windowId string) {
+	if key, last := t.removeWindow(windowId); last {
+		t.layoutMap.Delete(key)
+		delete(t.manual, key)
+	}
+	delete(t.windowKeys, windowId)
+	if windowId == t.currentWindowId {
+		t.currentWindowId = ""
+	}
+}
+
+// removeWindow forgets the closed window. It returns the layoutMap key of
+// the window and whether it's not used by other windows anymore.
+func (t *tracker) removeWindow(windowId string) (string, bool) {
+	key := t.layoutKey(windowId)
+	w, ok := t.windows[windowId]
+	if !ok {
+		return key, true
+	}
+	class := w.class
+	delete(t.windows, windowId)
+	t.classWindows[class]--
+	if t.classWindows[class] > 0 {
+		return key, key == windowId
+	}
+	delete(t.classWindows, class)
+	return key, true
+}
+
+// layoutKey returns what layout of the window is remembered for, the window
+// itself or its class, depending on track_by.
+func (t *tracker) layoutKey(windowId string) string {
+	if t.daemon.cfg.Load().TrackBy != "class" {
+		return windowId
+	}
+	if w, ok := t.windows[windowId]; ok {
+		return "class:" + w.class
+	}
+	return windowId
+}
+
+// switchTo switches layout of the current window right away, t.mu must be
+// held.
+func (t *tracker) switchTo(layout int) error {
+	return t.execute(t.plan(layout))
+}
+
+// single reports whether there is only one layout to switch to.
+func (t *tracker) single() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.layouts) == 1
+}
+
+// needsRedetect reports whether layouts are to be detected again.
+func (t *tracker) needsRedetect() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stale
+}
+
+// requestRedetect makes the event loop detect layouts again after the next
+// event.
+func (t *tracker) requestRedetect() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stale = true
+}
+
+// expectDetection records switches detection made, so their activelayout
+// isn't taken for the user's choice. t.mu must be held, if t is shared.
+func (t *tracker) expectDetection(detected *hypr.Layouts) {
+	t.detecting = nil
+	for _, i := range detected.Switched {
+		t.detecting = append(t.detecting, detected.Names[i])
+	}
+	t.detectingUntil = t.now().Add(selfSwitchTimeout)
+}
+
+// takeDetection reports whether activelayout with the layout name is caused
+// by detection. Events come in order, so switches before it are dropped.
+func (t *tracker) takeDetection(layout string) bool {
+	if len(t.detecting) == 0 {
+		return false
+	}
+	if t.now().After(t.detectingUntil) {
+		t.detecting = nil
+		return false
+	}
+	i := slices.Index(t.detecting, layout)
+	if i < 0 {
+		return false
+	}
+	t.detecting = t.detecting[i+1:]
+	return true
+}
+
+// indices returns layout indices by name, the map is replaced on redetect,
+// not changed.
+func (t *tracker) indices() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.layoutToIndex
+}
+
+// redetect detects layouts again and moves learned layouts to the new
+// indices of the same layout names. Layouts which are gone are forgotten.
+// It returns the new name to index mapping.
+func (t *tracker) redetect(ctx context.Context) (map[string]int, error) {
+	detected, err := t.client.ReadLayouts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not detect layouts: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stale = false
+	t.currentLayout = detected.Active
+	t.queriedAt = time.Time{}
+	t.expectDetection(detected)
+	if slices.Equal(t.layouts, detected.Names) {
+		return t.layoutToIndex, nil
+	}
+	slog.Info(fmt.Sprintf("Layouts changed: %v", detected.Names), "was", t.layouts)
+	old := t.layouts
+	layoutToIndex := make(map[string]int, len(detected.Names))
+	for i, l := range detected.Names {
+		layoutToIndex[l] = i
+	}
+	remap := func(layout int) (int, bool) {
+		if layout < 0 || layout >= len(old) {
+			return 0, false
+		}
+		idx, ok := layoutToIndex[old[layout]]
+		return idx, ok
+	}
+	t.layoutMap.Remap(remap)
+	for key, layout := range t.manual {
+		if idx, ok := remap(layout); ok {
+			t.manual[key] = idx
+		} else {
+			delete(t.manual, key)
+		}
+	}
+	t.daemon.st.Remap(remap)
+	// Indices of switches in flight are of the old layouts, their events
+	// are still to be told from the user's choice
+	inFlight := t.selfSwitches[:0]
+	for _, s := range t.selfSwitches {
+		if idx, ok := remap(s.layout); ok {
+			s.layout = idx
+			inFlight = append(inFlight, s)
+		}
+	}
+	t.selfSwitches = inFlight
+	t.layouts, t.layoutToIndex = detected.Names, layoutToIndex
+	return layoutToIndex, nil
+}
+
+// mirror plans switching mirrored keyboards to the layout the main one
+// switched to.
+func (t *tracker) mirror(layout int) {
+	if len(t.mirrored) == 0 || t.daemon.opts.DryRun || t.daemon.Paused() {
+		return
+	}
+	p := &switchPlan{mirror: true}
+	for _, kb := range t.mirrored {
+		p.actions = append(p.actions, Action{Device: kb, Layout: layout})
+	}
+	t.planned = append(t.planned, p)
+}
+
+// restore switches managed keyboards to the layout on shutdown.
+func (t *tracker) restore(layout int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending != nil {
+		t.pending.Stop()
+	}
+	if layout == t.currentLayout {
+		return
+	}
+	slog.Info(fmt.Sprintf("Restoring layout %s", t.layoutName(layout)), "layout", layout)
+	if err := t.switchTo(layout); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// queryCacheTTL is how long the active layout reported by Hyprland is
+// trusted, so quick focus changes don't query it each time.
+const queryCacheTTL = 500 * time.Millisecond
+
+// queryLayout returns the active layout as Hyprland reports it.
+func (t *tracker) queryLayout() (int, bool) {
+	if t.now().Sub(t.queriedAt) < queryCacheTTL {
+		return t.queried, true
+	}
+	keymap, err := t.client.ActiveKeymap(t.keyboard)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Could not query active layout: %s", err))
+		return 0, false
+	}
+	layout, ok := t.layoutToIndex[keymap]
+	if !ok {
+		return 0, false
+	}
+	if layout != t.currentLayout {
+		slog.Debug("Active layout changed unnoticed", "layout", layout, "was", t.currentLayout)
+	}
+	t.queried, t.queriedAt = layout, t.now()
+	return layout, true
+}
+
+// cycleSteps returns how many times to switch to the next layout to get to
+// the layout, negative for the previous one. It's 0 when switching by index.
+func (t *tracker) cycleSteps(layout int) int {
+	n := len(t.layouts)
+	if t.daemon.cfg.Load().SwitchStrategy != "cycle" || t.currentLayout < 0 || t.currentLayout >= n {
+		// Position is unknown, so only index can get to the layout
+		return 0
+	}
+	forward := ((layout-t.currentLayout)%n + n) % n
+	if forward <= n/2 {
+		return forward
+	}
+	return forward - n
+}
+
+// selfSwitch is a layout switch made by the daemon.
+type selfSwitch struct {
+	window string
+	layout int
+	at     time.Time
+}
+
+// selfSwitchTimeout is how long activelayout caused by our switch is
+// expected for. Later ones are taken as user's.
+const selfSwitchTimeout = time.Second
+
+// takeSelfSwitch reports whether activelayout with the layout is caused by
+// our switch, and which one. Switches made before it are dropped too, as
+// events come in order.
+func (t *tracker) takeSelfSwitch(layout int) (selfSwitch, bool) {
+	for i, s := range t.selfSwitches {
+		if t.now().Sub(s.at) > selfSwitchTimeout || s.layout != layout {
+			continue
+		}
+		t.selfSwitches = t.selfSwitches[i+1:]
+		return s, true
+	}
+	// Unmatched expired switches won't be reported anymore
+	t.selfSwitches = slices.DeleteFunc(t.selfSwitches, func(s selfSwitch) bool {
+		return t.now().Sub(s.at) > selfSwitchTimeout
+	})
+	return selfSwitch{}, false
+}
+
+// layoutName returns keymap name of the layout, empty if there is no such
+// layout.
+func (t *tracker) layoutName(layout int) string {
+	if layout < 0 || layout >= len(t.layouts) {
+		return ""
+	}
+	return t.layouts[layout]
+}
+
+// scheduleSwitch switches layout once focus stays on the window for d,
+// cancelling the switch scheduled for the previously focused window.
+func (t *tracker) scheduleSwitch(d time.Duration, windowId string, layout int) {
+	if t.pending != nil {
+		t.pending.Stop()
+	}
+	t.pending = time.AfterFunc(d, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.currentWindowId != windowId || t.currentLayout == layout || t.daemon.Paused() {
+			return
+		}
+		if err := t.switchTo(layout); err != nil {
+			slog.Error(err.Error())
+		}
+	})
+}
+
+// stop cancels the scheduled switch, if any.
+func (t *tracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending != nil {
+		t.pending.Stop()
+	}
+}
+
+// writeStatus publishes current layout name to the status file.
+func (t *tracker) writeStatus(layout string) {
+	if t.daemon.opts.StatusFile == "" {
+		return
+	}
+	if err := writeStatusFile(t.daemon.opts.StatusFile, layout); err != nil {
+		slog.Warn(err.Error())
+	}
+}
+
+// trackedWindows returns how many windows layouts are remembered for and how
+// many windows are known at all.
+func (t *tracker) trackedWindows() (tracked, known int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.layoutMap.Len(), len(t.windows)
+}
+
+// Status is the snapshot of what the daemon knows, reported over the control
+// socket.
+type Status struct {
+	Window     string         `json:"window"`
+	Layout     int            `json:"layout"`
+	LayoutName string         `json:"layout_name,omitempty"`
+	Layouts    []string       `json:"layouts"`
+	LayoutMap  map[string]int `json:"layout_map"`
+	Paused     bool           `json:"paused"`
+}
+
+func (t *tracker) status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Status{
+		Window:    t.currentWindowId,
+		Layout:    t.currentLayout,
+		Layouts:   t.layouts,
+		LayoutMap: t.layoutMap.Map(),
+		Paused:    t.daemon.Paused(),
+	}
+	s.LayoutName = t.layoutName(t.currentLayout)
+	return s
+}
@@ -0,0 +1,823 @@
+package perwindowlayout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"perwindowlayout/config"
+	"perwindowlayout/hypr"
+	"perwindowlayout/hypr/hyprtest"
+	"slices"
+	"testing"
+)
+
+// runTracker runs the daemon until client events are over and returns the
+// tracker of the connection.
+func runTracker(t *testing.T, cfg *config.Config, client *hyprtest.Client) *tracker {
+	t.Helper()
+	d := New(cfg, nil, Options{})
+	var tr *tracker
+	err := d.Run(context.Background(), client, func() {
+		if tr == nil {
+			tr = d.tracker.Load()
+		}
+	})
+	if tr == nil {
+		t.Fatalf("Run() = %v without events processed", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Run() = %v, want %v", err, io.EOF)
+	}
+	return tr
+}
+
+// switches runs the events with the config and returns the switches made.
+// Like Hyprland, the client reports each switch with activelayout.
+func switches(t *testing.T, config string, events ...hypr.Event) []hyprtest.Switch {
+	t.Helper()
+	return switchesOn(t, testLayouts, config, events...)
+}
+
+// switchesOn is switches with the layouts detected.
+func switchesOn(t *testing.T, layouts hypr.Layouts, config string, events ...hypr.Event) []hyprtest.Switch {
+	t.Helper()
+	client := hyprtest.NewClient(layouts, events...)
+	client.Echo = true
+	runTracker(t, loadConfig(t, config), client)
+	return client.Switches()
+}
+
+// script joins the events of the steps.
+func script(steps ...[]hypr.Event) []hypr.Event {
+	return slices.Concat(steps...)
+}
+
+// focus is what Hyprland reports when the window gets focused.
+func focus(addr, class, title string) []hypr.Event {
+	return []hypr.Event{
+		hyprtest.Event("activewindow", class+","+title),
+		hyprtest.Event("activewindowv2", addr),
+	}
+}
+
+// chosen is the layout chosen by hand on the main keyboard.
+func chosen(layout string) []hypr.Event {
+	return []hypr.Event{hyprtest.Event("activelayout", "kb,"+layout)}
+}
+
+func opened(addr, class, title string) []hypr.Event {
+	return []hypr.Event{hyprtest.Event("openwindow", addr+",1,"+class+","+title)}
+}
+
+func closed(addr string) []hypr.Event {
+	return []hypr.Event{hyprtest.Event("closewindow", addr)}
+}
+
+func TestFocusPatterns(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		events []hypr.Event
+		want   []hyprtest.Switch
+	}{
+		{
+			name:   "new windows take the default",
+			events: script(focus("a1", "kitty", "zsh"), focus("b2", "firefox", "Firefox")),
+		},
+		{
+			name:   "new window with other default",
+			config: "default_layout = \"German\"",
+			events: script(focus("a1", "kitty", "zsh"), focus("b2", "firefox", "Firefox")),
+			want:   []hyprtest.Switch{{Device: "kb", Layout: 2}},
+		},
+		{
+			name: "chosen layout follows the window",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"),
+				focus("b2", "firefox", "Firefox"),
+				focus("a1", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1}},
+		},
+		{
+			name: "focus on the same window",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"),
+				focus("a1", "kitty", "zsh"), focus("a1", "kitty", "zsh"),
+			),
+		},
+		{
+			name: "alternating windows",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"),
+				focus("b2", "firefox", "Firefox"), chosen("German"),
+				focus("a1", "kitty", "zsh"), focus("b2", "firefox", "Firefox"), focus("a1", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{
+				{Device: "kb", Layout: 0},
+				{Device: "kb", Layout: 1}, {Device: "kb", Layout: 2}, {Device: "kb", Layout: 1},
+			},
+		},
+		{
+			name: "reopened window takes the learned layout",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"), closed("a1"),
+				focus("c3", "firefox", "Firefox"),
+				focus("b2", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1}},
+		},
+		{
+			name:   "reopened window takes the default",
+			config: "force_default_on_open = true",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"), closed("a1"),
+				opened("b2", "kitty", "zsh"), focus("b2", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 0}},
+		},
+		{
+			name:   "ignored window keeps the layout",
+			config: "ignore = [\"steam\"]",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"),
+				focus("b2", "steam", "Steam"), chosen("German"),
+				focus("a1", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := switches(t, tt.config, tt.events...); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFullscreenAndLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []hypr.Event
+	}{
+		{
+			name: "fullscreen toggle",
+			events: script(
+				[]hypr.Event{hyprtest.Event("fullscreen", "1")},
+				focus("a1", "kitty", "zsh"),
+				[]hypr.Event{hyprtest.Event("fullscreen", "0")},
+				focus("a1", "kitty", "zsh"),
+			),
+		},
+		{
+			name: "launcher layer",
+			events: script(
+				[]hypr.Event{hyprtest.Event("openlayer", "rofi")},
+				focus("", "", ""),
+				[]hypr.Event{hyprtest.Event("closelayer", "rofi")},
+				focus("a1", "kitty", "zsh"),
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := script(focus("a1", "kitty", "zsh"), chosen("Russian"), tt.events)
+			if got := switches(t, "", events...); len(got) > 0 {
+				t.Errorf("switches = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestMonitorDefaults(t *testing.T) {
+	config := `
+[monitors]
+DP-1 = "German"
+HDMI-A-1 = "Russian"
+
+[workspaces]
+"5" = "English (US)"
+
+[[rules]]
+class = "telegram"
+layout = "Russian"
+`
+	monitor := func(name, workspace string) []hypr.Event {
+		return []hypr.Event{hyprtest.Event("focusedmon", name+","+workspace)}
+	}
+	tests := []struct {
+		name   string
+		events []hypr.Event
+		want   []hyprtest.Switch
+	}{
+		{
+			name:   "listed monitor",
+			events: script(monitor("DP-1", "2"), focus("a1", "kitty", "zsh")),
+			want:   []hyprtest.Switch{{Device: "kb", Layout: 2}},
+		},
+		{
+			name:   "not listed monitor",
+			events: script(monitor("eDP-1", "1"), focus("a1", "kitty", "zsh")),
+		},
+		{
+			name: "monitor switch",
+			events: script(
+				monitor("DP-1", "2"), focus("a1", "kitty", "zsh"),
+				monitor("HDMI-A-1", "3"), focus("b2", "kitty", "vim"),
+				monitor("eDP-1", "1"), focus("c3", "foot", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 2}, {Device: "kb", Layout: 1}, {Device: "kb", Layout: 0}},
+		},
+		{
+			name: "learned goes first",
+			events: script(
+				monitor("DP-1", "2"), focus("a1", "kitty", "zsh"), chosen("English (US)"),
+				monitor("HDMI-A-1", "3"), focus("b2", "foot", "zsh"), focus("a1", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 2}, {Device: "kb", Layout: 1}, {Device: "kb", Layout: 0}},
+		},
+		{
+			name: "rule and workspace go first",
+			events: script(
+				monitor("DP-1", "2"), focus("a1", "telegram", "Telegram"),
+				monitor("DP-1", "5"), focus("b2", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 1}, {Device: "kb", Layout: 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := switches(t, config, tt.events...); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOtherKeyboards(t *testing.T) {
+	layouts := testLayouts
+	layouts.Keyboards = []string{"kb", "ext"}
+	ext := func(layout string) []hypr.Event {
+		return []hypr.Event{hyprtest.Event("activelayout", "ext,"+layout)}
+	}
+	tests := []struct {
+		name   string
+		config string
+		events []hypr.Event
+		want   []hyprtest.Switch
+	}{
+		{
+			name: "other keyboard layout is not chosen",
+			events: script(
+				focus("a1", "kitty", "zsh"), ext("Russian"),
+				focus("b2", "firefox", "Firefox"), focus("a1", "kitty", "zsh"),
+			),
+		},
+		{
+			name: "main keyboard layout is chosen",
+			events: script(
+				focus("a1", "kitty", "zsh"),
+				ext("German"), chosen("Russian"), ext("English (US)"),
+				focus("b2", "firefox", "Firefox"), focus("a1", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1}},
+		},
+		{
+			name:   "other keyboard managed too",
+			config: "keyboards = [\"kb\", \"ext\"]",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"), ext("German"),
+				focus("b2", "firefox", "Firefox"),
+			),
+			want: []hyprtest.Switch{
+				{Device: "kb", Layout: 0}, {Device: "ext", Layout: 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := switchesOn(t, layouts, tt.config, tt.events...); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagedKeyboard(t *testing.T) {
+	ext := func(layout string) []hypr.Event {
+		return []hypr.Event{hyprtest.Event("activelayout", "ext,"+layout)}
+	}
+	events := script(
+		focus("a1", "kitty", "zsh"),
+		ext("Russian"), chosen("German"),
+		focus("b2", "firefox", "Firefox"),
+		ext("German"), chosen("Russian"),
+		focus("a1", "kitty", "zsh"),
+	)
+	tests := []struct {
+		name     string
+		keyboard string
+		config   string
+		want     []hyprtest.Switch
+	}{
+		{
+			name:     "main keyboard",
+			keyboard: "kb",
+			config:   `managed_keyboard = "kb"`,
+			want:     []hyprtest.Switch{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 2}},
+		},
+		{
+			name:     "other keyboard",
+			keyboard: "ext",
+			config:   `managed_keyboard = "ext"`,
+			want:     []hyprtest.Switch{{Device: "ext", Layout: 0}, {Device: "ext", Layout: 1}},
+		},
+		{
+			name:     "not found",
+			keyboard: "kb",
+			config:   `managed_keyboard = "usb"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layouts := testLayouts
+			layouts.Keyboard = tt.keyboard
+			layouts.Keyboards = []string{"kb", "ext"}
+			if got := switchesOn(t, layouts, tt.config, events...); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveLayout(t *testing.T) {
+	cfg := loadConfig(t, `
+default_layout = 1
+
+[workspaces]
+"2" = 2
+
+[monitors]
+DP-1 = 3
+
+[[rules]]
+class = "keepassxc"
+layout = 4
+pin_layout = true
+
+[[rules]]
+title = "ssh"
+layout = 5
+
+[[rules]]
+class = "kitty"
+layout = 6
+`)
+	tests := []struct {
+		name string
+		w    windowInfo
+		want int
+	}{
+		{"pinned over manual", windowInfo{class: "keepassxc", manual: 7, learned: 8}, 4},
+		{"manual over learned", windowInfo{class: "kitty", manual: 7, learned: 8}, 7},
+		{"learned over rule", windowInfo{class: "kitty", manual: -1, learned: 8}, 8},
+		{"learned over default", windowInfo{class: "foot", manual: -1, learned: 0}, 0},
+		{"title rule over class rule", windowInfo{class: "kitty", title: "ssh host", manual: -1, learned: -1}, 5},
+		{"class rule over workspace", windowInfo{class: "kitty", workspace: "2", manual: -1, learned: -1}, 6},
+		{"workspace over monitor", windowInfo{class: "foot", workspace: "2", monitor: "DP-1", manual: -1, learned: -1}, 2},
+		{"monitor over default", windowInfo{class: "foot", workspace: "1", monitor: "DP-1", manual: -1, learned: -1}, 3},
+		{"default", windowInfo{class: "foot", workspace: "1", monitor: "eDP-1", manual: -1, learned: -1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveLayout(cfg, tt.w); got != tt.want {
+				t.Errorf("resolveLayout(%+v) = %d, want %d", tt.w, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowCache(t *testing.T) {
+	client := hyprtest.NewClient(testLayouts, script(
+		opened("b2", "firefox", "Mozilla Firefox"),
+		[]hypr.Event{
+			hyprtest.Event("windowtitlev2", "a1,ssh prod, db"),
+			hyprtest.Event("windowtitlev2", "ff,unknown window"),
+		},
+		opened("c3", "foot", "zsh"), closed("c3"),
+		// Focus is reported without activewindow
+		[]hypr.Event{
+			hyprtest.Event("activewindowv2", "a1"),
+			hyprtest.Event("activewindowv2", "b2"),
+		},
+	)...)
+	client.Windows = []hypr.Window{
+		{Address: "0xa1", Class: "kitty", Title: "zsh"},
+		{Address: "0xd4", Class: "kitty", Title: "vim"},
+	}
+	client.Echo = true
+	tr := runTracker(t, loadConfig(t, "[[rules]]\ntitle = \"^ssh prod\"\nlayout = \"Russian\""), client)
+
+	want := map[string]windowMeta{
+		"a1": {class: "kitty", title: "ssh prod, db"},
+		"b2": {class: "firefox", title: "Mozilla Firefox"},
+		"d4": {class: "kitty", title: "vim"},
+	}
+	if !maps.Equal(tr.windows, want) {
+		t.Errorf("windows = %v, want %v", tr.windows, want)
+	}
+	if want := map[string]int{"kitty": 2, "firefox": 1}; !maps.Equal(tr.classWindows, want) {
+		t.Errorf("classWindows = %v, want %v", tr.classWindows, want)
+	}
+	// The rule matches the title known from the cache
+	wantSwitches := []hyprtest.Switch{{Device: "kb", Layout: 1}, {Device: "kb", Layout: 0}}
+	if got := client.Switches(); !slices.Equal(got, wantSwitches) {
+		t.Errorf("switches = %v, want %v", got, wantSwitches)
+	}
+}
+
+func TestFocusDesktop(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []hypr.Event
+		want   []hyprtest.Switch
+	}{
+		{
+			name:   "empty address",
+			events: script(focus("", "", ""), focus("a1", "kitty", "zsh")),
+			want:   []hyprtest.Switch{{Device: "kb", Layout: 2}},
+		},
+		{
+			name:   "zero address",
+			events: script(focus("0x0", "", ""), focus("a1", "kitty", "zsh")),
+			want:   []hyprtest.Switch{{Device: "kb", Layout: 2}},
+		},
+		{
+			name:   "layout chosen on desktop",
+			events: script(focus("0x0", "", ""), chosen("German"), focus("a1", "kitty", "zsh")),
+			want:   []hyprtest.Switch{{Device: "kb", Layout: 2}, {Device: "kb", Layout: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a1 is switched to the default, then Russian is chosen in it
+			events := script(focus("a1", "kitty", "zsh"), chosen("Russian"), tt.events)
+			if got := switches(t, "default_layout = 2", events...); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapBack(t *testing.T) {
+	config := "[allowed]\nkitty = [\"English (US)\", \"German\"]"
+	tests := []struct {
+		name   string
+		events []hypr.Event
+		want   []hyprtest.Switch
+	}{
+		{
+			name:   "next layout",
+			events: script(focus("a1", "kitty", "zsh"), chosen("Russian")),
+			want:   []hyprtest.Switch{{Device: "kb", Layout: 2}},
+		},
+		{
+			name: "previous layout",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("German"),
+				chosen("Russian"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 0}},
+		},
+		{
+			name: "snapped layout is remembered",
+			events: script(
+				focus("a1", "kitty", "zsh"), chosen("Russian"),
+				focus("b2", "firefox", "Firefox"), focus("a1", "kitty", "zsh"),
+			),
+			want: []hyprtest.Switch{{Device: "kb", Layout: 2}, {Device: "kb", Layout: 0}, {Device: "kb", Layout: 2}},
+		},
+		{
+			name:   "allowed layout",
+			events: script(focus("a1", "kitty", "zsh"), chosen("German")),
+		},
+		{
+			name:   "not restricted class",
+			events: script(focus("a1", "foot", "zsh"), chosen("Russian")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := switches(t, config, tt.events...); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapBackPaused(t *testing.T) {
+	config := "[allowed]\nkitty = [\"English (US)\", \"German\"]"
+	events := script(
+		focus("a1", "kitty", "zsh"), chosen("Russian"),
+		focus("b2", "firefox", "Firefox"), focus("a1", "kitty", "zsh"),
+	)
+	tests := []struct {
+		name string
+		// before are called before the event with the number is handled,
+		// counting from 1
+		before map[int]func(d *Daemon)
+		want   []hyprtest.Switch
+	}{
+		{
+			name: "paused",
+			before: map[int]func(d *Daemon){
+				3: func(d *Daemon) { d.SetPaused(true) },
+			},
+		},
+		{
+			name: "resumed",
+			before: map[int]func(d *Daemon){
+				3: func(d *Daemon) { d.SetPaused(true) },
+				4: func(d *Daemon) { d.SetPaused(false) },
+			},
+			want: []hyprtest.Switch{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1}},
+		},
+		{
+			name: "toggled",
+			before: map[int]func(d *Daemon){
+				3: func(d *Daemon) {
+					if !d.TogglePaused() {
+						t.Errorf("TogglePaused() = false, want paused")
+					}
+				},
+				4: func(d *Daemon) {
+					if d.TogglePaused() {
+						t.Errorf("TogglePaused() = true, want resumed")
+					}
+				},
+			},
+			want: []hyprtest.Switch{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := hyprtest.NewClient(testLayouts, events...)
+			client.Echo = true
+			d := New(loadConfig(t, config), nil, Options{})
+			var tr *tracker
+			read := 0
+			err := d.Run(context.Background(), client, func() {
+				tr = d.tracker.Load()
+				read++
+				if f := tt.before[read]; f != nil {
+					f(d)
+				}
+			})
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("Run() = %v, want %v", err, io.EOF)
+			}
+			if got := client.Switches(); !slices.Equal(got, tt.want) {
+				t.Errorf("switches = %v, want %v", got, tt.want)
+			}
+			// Chosen while paused, so it's not switched back
+			if got, ok := tr.manual["a1"]; !ok || got != 1 {
+				t.Errorf("manual layout of a1 = %d, %t, want 1", got, ok)
+			}
+		})
+	}
+}
+
+func TestHideAndReveal(t *testing.T) {
+	tests := []struct {
+		name string
+		hide []hypr.Event
+	}{
+		{
+			name: "movewindowv2",
+			hide: []hypr.Event{hyprtest.Event("movewindowv2", "a1,-98,special:minimized")},
+		},
+		{
+			name: "movewindow",
+			hide: []hypr.Event{hyprtest.Event("movewindow", "a1,special:minimized")},
+		},
+		{
+			name: "scratchpad",
+			hide: []hypr.Event{
+				hyprtest.Event("activespecial", "special:scratch,DP-1"),
+				hyprtest.Event("activespecial", ",DP-1"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := hyprtest.NewClient(testLayouts, script(
+				opened("a1", "kitty", "zsh"), focus("a1", "kitty", "zsh"), chosen("Russian"),
+				opened("b2", "firefox", "Firefox"),
+				tt.hide,
+				focus("b2", "firefox", "Firefox"),
+				[]hypr.Event{hyprtest.Event("activespecial", "special:minimized,DP-1")},
+				focus("a1", "kitty", "zsh"),
+			)...)
+			client.Echo = true
+			tr := runTracker(t, loadConfig(t, ""), client)
+			want := []hyprtest.Switch{{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1}}
+			if got := client.Switches(); !slices.Equal(got, want) {
+				t.Errorf("switches = %v, want %v", got, want)
+			}
+			// Not just learned from the same class and title
+			if got, ok := tr.manual["a1"]; !ok || got != 1 {
+				t.Errorf("manual layout of a1 = %d, %t, want 1", got, ok)
+			}
+		})
+	}
+}
+
+func TestPinnedLayout(t *testing.T) {
+	client := hyprtest.NewClient(testLayouts, script(
+		opened("a1", "keepassxc", "Passwords"), focus("a1", "keepassxc", "Passwords"),
+		chosen("German"),
+		focus("b2", "firefox", "Firefox"),
+		focus("a1", "keepassxc", "Passwords"), chosen("English (US)"), chosen("German"),
+		focus("b2", "firefox", "Firefox"), focus("a1", "keepassxc", "Passwords"),
+	)...)
+	client.Echo = true
+	tr := runTracker(t, loadConfig(t, "[[rules]]\nclass = \"keepassxc\"\nlayout = \"Russian\"\npin_layout = true"), client)
+
+	want := []hyprtest.Switch{
+		{Device: "kb", Layout: 1},
+		{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1},
+		{Device: "kb", Layout: 0}, {Device: "kb", Layout: 1},
+	}
+	if got := client.Switches(); !slices.Equal(got, want) {
+		t.Errorf("switches = %v, want %v", got, want)
+	}
+	if got, ok := tr.manual["a1"]; ok {
+		t.Errorf("manual layout of pinned a1 = %d, want none", got)
+	}
+	if got, ok := tr.layoutMap.Get("a1"); ok && got != 1 {
+		t.Errorf("learned layout of pinned a1 = %d, want none or 1", got)
+	}
+	if got, ok := tr.daemon.st.Layouts[stateKey("", "keepassxc", "Passwords")]; ok && got != 1 {
+		t.Errorf("persisted layout of pinned a1 = %d, want none or 1", got)
+	}
+}
+
+func TestOpenCloseSoak(t *testing.T) {
+	var events []hypr.Event
+	events = append(events,
+		hyprtest.Event("activewindowv2", "f1"),
+		hyprtest.Event("activelayout", "kb,German"),
+	)
+	for i := 0; i < 5000; i++ {
+		addr := fmt.Sprintf("%x", 0x1000+i)
+		events = append(events,
+			hyprtest.Event("openwindow", addr+",1,kitty,zsh"),
+			hyprtest.Event("activewindowv2", addr),
+			hyprtest.Event("activelayout", "kb,Russian"),
+			hyprtest.Event("closewindow", addr),
+		)
+	}
+	client := hyprtest.NewClient(testLayouts, events...)
+	client.Windows = []hypr.Window{{Address: "0xf1", Class: "firefox", Title: "Mozilla Firefox"}}
+	tr := runTracker(t, loadConfig(t, "max_windows = 8"), client)
+
+	if got, want := tr.windows, map[string]windowMeta{"f1": {class: "firefox", title: "Mozilla Firefox"}}; !maps.Equal(got, want) {
+		t.Errorf("windows = %v, want %v", got, want)
+	}
+	if got, want := tr.classWindows, map[string]int{"firefox": 1}; !maps.Equal(got, want) {
+		t.Errorf("classWindows = %v, want %v", got, want)
+	}
+	if got, want := tr.manual, map[string]int{"f1": 2}; !maps.Equal(got, want) {
+		t.Errorf("manual = %v, want %v", got, want)
+	}
+	if got, want := tr.layoutMap.Map(), map[string]int{"f1": 2}; !maps.Equal(got, want) {
+		t.Errorf("layoutMap = %v, want %v", got, want)
+	}
+	if len(tr.windowKeys) != 1 {
+		t.Errorf("windowKeys = %v, want only f1", tr.windowKeys)
+	}
+}
+
+func TestPruneMissedClose(t *testing.T) {
+	events := []hypr.Event{
+		hyprtest.Event("activewindowv2", "c1"),
+		hyprtest.Event("activelayout", "kb,Russian"),
+	}
+	// closewindow of these is missed
+	for i := 0; i < 100; i++ {
+		events = append(events, hyprtest.Event("openwindow", fmt.Sprintf("%x,1,foot,zsh", 0x1000+i)))
+	}
+	client := hyprtest.NewClient(testLayouts, events...)
+	client.Windows = []hypr.Window{
+		// Ignored and never focused
+		{Address: "0x51", Class: "steam", Title: "Steam"},
+		{Address: "0xa1", Class: "kitty", Title: "vim"},
+		{Address: "0xc1", Class: "kitty", Title: "zsh"},
+	}
+	tr := runTracker(t, loadConfig(t, "max_windows = 4\nignore = [\"steam\"]"), client)
+
+	for _, w := range client.Windows {
+		if _, ok := tr.windows[windowAddress(w.Address)]; !ok {
+			t.Errorf("open window %s is forgotten", w.Address)
+		}
+	}
+	if got := tr.classWindows["kitty"]; got != 2 {
+		t.Errorf("open kitty windows = %d, want 2", got)
+	}
+	if got, ok := tr.manual["c1"]; !ok || got != 1 {
+		t.Errorf("manual layout of c1 = %d, %t, want 1", got, ok)
+	}
+	if got := len(tr.windows); got > 2*4 {
+		t.Errorf("known windows = %d, want at most %d", got, 2*4)
+	}
+	if got := tr.classWindows["foot"]; got != len(tr.windows)-len(client.Windows) {
+		t.Errorf("foot windows = %d, %d are known", got, len(tr.windows)-len(client.Windows))
+	}
+}
+
+func TestEvictForgetsManual(t *testing.T) {
+	var events []hypr.Event
+	for i := 0; i < 10; i++ {
+		addr := fmt.Sprintf("%x", 0x1000+i)
+		events = append(events,
+			hyprtest.Event("openwindow", addr+",1,kitty,zsh"),
+			hyprtest.Event("activewindowv2", addr),
+			hyprtest.Event("activelayout", "kb,Russian"),
+		)
+	}
+	var windows []hypr.Window
+	for i := 0; i < 10; i++ {
+		windows = append(windows, hypr.Window{Address: fmt.Sprintf("0x%x", 0x1000+i), Class: "kitty", Title: "zsh"})
+	}
+	client := hyprtest.NewClient(testLayouts, events...)
+	client.Windows = windows
+	tr := runTracker(t, loadConfig(t, "max_windows = 4"), client)
+
+	if got := tr.layoutMap.Len(); got != 4 {
+		t.Errorf("remembered layouts = %d, want 4", got)
+	}
+	if !maps.Equal(tr.manual, tr.layoutMap.Map()) {
+		t.Errorf("manual = %v, want the same as layoutMap %v", tr.manual, tr.layoutMap.Map())
+	}
+	if got := len(tr.windows); got != 10 {
+		t.Errorf("known windows = %d, want all 10 open", got)
+	}
+}
+
+func TestRedetectSwitches(t *testing.T) {
+	layouts := testLayouts
+	layouts.Keyboards = []string{"kb", "ext"}
+	// German became French, which isn't cached, so detection switches to
+	// each layout and back
+	redetected := hypr.Layouts{
+		Keyboard:  "kb",
+		Names:     []string{"English (US)", "Russian", "French"},
+		Shorts:    []string{"us", "ru", "fr"},
+		Keyboards: []string{"kb", "ext"},
+		Active:    2,
+		Switched:  []int{0, 1, 2},
+	}
+	client := hyprtest.NewClient(layouts, script(
+		focus("a1", "kitty", "zsh"), chosen("French"), chosen("Russian"),
+	)...)
+	client.Echo = true
+	d := New(loadConfig(t, `mirror = ["ext"]`), nil, Options{})
+	changes, unsubscribe := d.Subscribe()
+	defer unsubscribe()
+	var tr *tracker
+	read := 0
+	err := d.Run(context.Background(), client, func() {
+		tr = d.tracker.Load()
+		read++
+		if read == 3 {
+			client.SetLayouts(redetected)
+		}
+	})
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Run() = %v, want %v", err, io.EOF)
+	}
+	if !slices.Equal(tr.layouts, redetected.Names) {
+		t.Errorf("layouts = %q, want %q", tr.layouts, redetected.Names)
+	}
+	if tr.stale || len(tr.unknownLayouts) != 1 {
+		t.Errorf("stale = %t, unknown layouts = %v, want detected once for French", tr.stale, tr.unknownLayouts)
+	}
+	// Only the layout chosen after detection is learned and mirrored
+	if got, ok := tr.manual["a1"]; !ok || got != 1 {
+		t.Errorf("manual layout of a1 = %d, %t, want 1", got, ok)
+	}
+	if got, want := client.Switches(), []hyprtest.Switch{{Device: "ext", Layout: 1}}; !slices.Equal(got, want) {
+		t.Errorf("switches = %v, want %v", got, want)
+	}
+	published := 0
+	for len(changes) > 0 {
+		<-changes
+		published++
+	}
+	if published != 1 {
+		t.Errorf("published %d changes, want 1", published)
+	}
+}
@@ -0,0 +1,35 @@
+// Package xdg resolves where the daemon keeps its files according to the XDG
+// Base Directory Specification.
+package xdg
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// appDir is the per-application subdirectory in each base directory.
+const appDir = "per-window-layout"
+
+// baseDir returns $env if it's an absolute path, fallback under $HOME
+// otherwise, as the specification says relative paths must be ignored.
+func baseDir(env, fallback string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), fallback)
+}
+
+// ConfigFile returns path of the named file in $XDG_CONFIG_HOME.
+func ConfigFile(name string) string {
+	return filepath.Join(baseDir("XDG_CONFIG_HOME", ".config"), appDir, name)
+}
+
+// StateFile returns path of the named file in $XDG_STATE_HOME.
+func StateFile(name string) string {
+	return filepath.Join(baseDir("XDG_STATE_HOME", ".local/state"), appDir, name)
+}
+
+// CacheFile returns path of the named file in $XDG_CACHE_HOME.
+func CacheFile(name string) string {
+	return filepath.Join(baseDir("XDG_CACHE_HOME", ".cache"), appDir, name)
+}